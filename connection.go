@@ -2,8 +2,14 @@ package flexmem
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
 
 	"git.kanosolution.net/kano/dbflex"
+	"git.kanosolution.net/kano/dbflex/orm"
+	"github.com/eaciit/toolkit"
 )
 
 type Connection struct {
@@ -13,18 +19,53 @@ type Connection struct {
 
 	records []interface{}
 	index   int
+
+	tx *memTx
+
+	idGenerator IDGenerator
+
+	autoCreate bool
+	idField    string
 }
 
 func (conn *Connection) Connect() error {
+	autoCreate, e := configBool(conn.Config, ConfigAutoCreate)
+	if e != nil {
+		return e
+	}
+	conn.autoCreate = autoCreate
+	conn.idField = conn.Config.GetString(ConfigIDField)
+	if conn.idField == "" {
+		conn.idField = DefaultIDField
+	}
 	conn.state = dbflex.StateConnected
 	return nil
 }
 
+// configBool reads a connection config given either as bool or as string
+func configBool(config toolkit.M, key string) (bool, error) {
+	switch v := config.Get(key, false).(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, e := strconv.ParseBool(v)
+		if e != nil {
+			return false, fmt.Errorf("invalid config %s. %s", key, e.Error())
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("invalid config %s. %v is not a bool", key, v)
+	}
+}
+
 func (conn *Connection) State() string {
 	return conn.state
 }
 
 func (conn *Connection) Close() {
+	if conn.tx != nil {
+		conn.RollBack()
+	}
 	conn.state = ""
 }
 
@@ -32,13 +73,48 @@ func (conn *Connection) NewQuery() dbflex.IQuery {
 	qr := new(Query)
 	qr.SetThis(qr)
 	qr.SetConnection(conn)
+	qr.conn = conn
 	return qr
 }
 
+// database returns the database selected by the connection URI, creating it
+// when it doesn't exist yet
+func (conn *Connection) database() *memDatabase {
+	return getDatabase(conn.Database)
+}
+
+// table returns a table of the database of the connection, a missing database
+// has no tables and is not created
+func (conn *Connection) table(name string) (*memTable, bool) {
+	db, ok := lookupDatabase(conn.Database)
+	if !ok {
+		return nil, false
+	}
+	return db.table(name)
+}
+
+// RegisterObject creates the table of a model in the database of the connection
+func (conn *Connection) RegisterObject(data interface{}) error {
+	return conn.database().register(data)
+}
+
+// DropDatabase removes the database of the connection with all of its tables
+// and sequences
+func (conn *Connection) DropDatabase() error {
+	dropDatabase(conn.Database)
+	return nil
+}
+
 func (conn *Connection) ObjectNames(_ dbflex.ObjTypeEnum) []string {
-	res := make([]string, len(tables))
+	db, ok := lookupDatabase(conn.Database)
+	if !ok {
+		return []string{}
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	res := make([]string, len(db.tables))
 	i := 0
-	for k := range tables {
+	for k := range db.tables {
 		res[i] = k
 		i++
 	}
@@ -50,37 +126,121 @@ func (conn *Connection) ValidateTable(_ interface{}, _ bool) error {
 }
 
 func (conn *Connection) DropTable(name string) error {
+	db, ok := lookupDatabase(conn.Database)
+	if !ok {
+		return nil
+	}
 	lock.Lock()
-	delete(tables, name)
+	if table, ok := db.tables[name]; ok {
+		table.dropped = true
+		delete(db.tables, name)
+	}
 	lock.Unlock()
 	return nil
 }
 
 func (conn *Connection) HasTable(name string) bool {
-	_, ok := tables[name]
+	_, ok := conn.table(name)
 	return ok
 }
 
-func (conn *Connection) EnsureTable(_ string, _ []string, _ interface{}) error {
+// EnsureTable makes sure the table exists and creates a hash index for each of the keys.
+// obj, when given, is a pointer to an orm.DataModel used as model of new records of the table
+func (conn *Connection) EnsureTable(name string, keys []string, obj interface{}) error {
+	var model reflect.Type
+	if obj != nil {
+		if _, ok := obj.(orm.DataModel); !ok {
+			return fmt.Errorf("object need to implements orm.datamodel")
+		}
+		model = reflect.TypeOf(obj)
+		if model.Kind() != reflect.Ptr {
+			return fmt.Errorf("object of table %s should be a pointer", name)
+		}
+	}
+	table := conn.database().ensureTable(name, model, conn.idField)
+
+	for _, key := range keys {
+		if e := table.EnsureIndex(Index{Fields: []string{key}}); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// EnsureIndex creates a secondary index on a table
+func (conn *Connection) EnsureIndex(tableName string, index Index) error {
+	table, ok := conn.table(tableName)
+	if !ok {
+		return fmt.Errorf("table %s is not registered yet", tableName)
+	}
+	return table.EnsureIndex(index)
+}
+
+// SetIDGenerator sets the generator of IDs for records inserted through the
+// connection with an empty ID into tables without their own generator
+func (conn *Connection) SetIDGenerator(gen IDGenerator) {
+	conn.idGenerator = gen
+}
+
+// SetTableIDGenerator sets the generator of IDs for records inserted into a table
+// with an empty ID. The generator is reset when the table is registered again
+func (conn *Connection) SetTableIDGenerator(tableName string, gen IDGenerator) error {
+	table, ok := conn.table(tableName)
+	if !ok {
+		return fmt.Errorf("table %s is not registered yet", tableName)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	table.idGenerator = gen
 	return nil
 }
 
+// RecordVersion returns the current version of a record as seen by the connection,
+// key is the record key as returned by RecordKey, or DocumentKey for schemaless tables
+func (conn *Connection) RecordVersion(tableName, key string) (int64, error) {
+	table, ok := conn.table(tableName)
+	if !ok {
+		return 0, fmt.Errorf("table %s is not registered yet", tableName)
+	}
+
+	var view tableView = table
+	if conn.tx != nil {
+		view = conn.tx.table(table)
+	}
+	version, _ := view.Version(key)
+	return version, nil
+}
+
 func (conn *Connection) BeginTx() error {
-	panic("not implemented") // TODO: Implement
+	if conn.tx != nil {
+		return errors.New("transaction has been started")
+	}
+	conn.tx = newMemTx()
+	return nil
 }
 
 func (conn *Connection) Commit() error {
-	panic("not implemented") // TODO: Implement
+	if conn.tx == nil {
+		return errors.New("no active transaction")
+	}
+	tx := conn.tx
+	conn.tx = nil
+	return tx.commit()
 }
 
 func (conn *Connection) RollBack() error {
-	panic("not implemented") // TODO: Implement
+	if conn.tx == nil {
+		return errors.New("no active transaction")
+	}
+	conn.tx.release()
+	conn.tx = nil
+	return nil
 }
 
 func (conn *Connection) SupportTx() bool {
-	panic("not implemented") // TODO: Implement
+	return true
 }
 
 func (conn *Connection) IsTx() bool {
-	panic("not implemented") // TODO: Implement
+	return conn.tx != nil
 }
@@ -7,6 +7,7 @@ import (
 
 	"git.kanosolution.net/kano/dbflex"
 	"github.com/ariefdarmawan/reflector"
+	"github.com/eaciit/toolkit"
 )
 
 type Cursor struct {
@@ -14,6 +15,8 @@ type Cursor struct {
 
 	records     []interface{}
 	recordIndex int
+
+	fields []string
 }
 
 func (cr *Cursor) Reset() error {
@@ -25,7 +28,7 @@ func (cr *Cursor) Fetch(out interface{}) dbflex.ICursor {
 		return cr.SetError(io.EOF)
 	}
 
-	elem := cr.records[cr.recordIndex]
+	elem := cr.project(cr.records[cr.recordIndex], reflect.TypeOf(out))
 	if e := reflector.AssignValue(reflect.ValueOf(elem), reflect.ValueOf(out)); e != nil {
 		return cr.SetError(fmt.Errorf("error on serializing fetch. %s", e.Error()))
 	}
@@ -58,7 +61,7 @@ func (cr *Cursor) Fetchs(dest interface{}, n int) dbflex.ICursor {
 	newDest := reflect.MakeSlice(vdest.Type(), nRead, nRead)
 	newDest = reflect.New(newDest.Type())
 	for (fetched < nRead) && (cr.recordIndex < dataCount) {
-		elem := cr.records[cr.recordIndex]
+		elem := cr.project(cr.records[cr.recordIndex], vdest.Type().Elem())
 		vElem := reflect.ValueOf(elem)
 		if e := reflector.AssignSliceItem(vElem, fetched, newDest); e != nil {
 			return cr.SetError(fmt.Errorf("error serializing during fetchs process. %s", e.Error()))
@@ -87,3 +90,48 @@ func (cr *Cursor) Close() error {
 	}
 	return nil
 }
+
+// project returns a record that only has the selected fields of the cursor. When
+// destination is a map the record is projected into a toolkit.M, otherwise it
+// is projected into a new record of the same type with unselected fields left zero.
+// Dotted fields are projected into nested values. Without selected fields a copy
+// of the record is returned, as records of the cursor are stored versions
+func (cr *Cursor) project(rec interface{}, destType reflect.Type) interface{} {
+	if rec == nil {
+		return rec
+	}
+	if len(cr.fields) == 0 {
+		return cloneRecord(rec)
+	}
+
+	for destType.Kind() == reflect.Ptr {
+		destType = destType.Elem()
+	}
+	rv := reflect.ValueOf(rec)
+	if destType.Kind() == reflect.Map || reflect.Indirect(rv).Kind() != reflect.Struct {
+		res := toolkit.M{}
+		for _, field := range cr.fields {
+			if v, e := getFieldValue(rec, field); e == nil {
+				setFieldValue(res, field, v)
+			}
+		}
+		return res
+	}
+
+	var res reflect.Value
+	if rv.Kind() == reflect.Ptr {
+		res = reflect.New(rv.Elem().Type())
+	} else {
+		res = reflect.New(rv.Type())
+	}
+	for _, field := range cr.fields {
+		if v, e := getFieldValue(rec, field); e == nil {
+			setFieldValue(res.Interface(), field, v)
+		}
+	}
+
+	if rv.Kind() == reflect.Ptr {
+		return res.Interface()
+	}
+	return res.Elem().Interface()
+}
@@ -0,0 +1,117 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+
+	"git.kanosolution.net/kano/dbflex/orm"
+)
+
+// memDatabase is an isolated namespace of tables and sequences, selected by the
+// database of the connection URI. Its maps are guarded by the package lock
+type memDatabase struct {
+	name   string
+	tables map[string]*memTable
+
+	sequenceTable *memTable
+	sequenceDefs  map[string]Sequence
+}
+
+func newMemDatabase(name string) *memDatabase {
+	db := new(memDatabase)
+	db.name = name
+	db.tables = map[string]*memTable{}
+	db.sequenceTable = newMemTable()
+	db.sequenceTable.name = "$sequences"
+	db.sequenceDefs = map[string]Sequence{}
+	return db
+}
+
+// getDatabase returns the database of the given name, creating it when it
+// doesn't exist yet. The empty name is the default database
+func getDatabase(name string) *memDatabase {
+	db, ok := lookupDatabase(name)
+	if ok {
+		return db
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if db, ok = databases[name]; !ok {
+		db = newMemDatabase(name)
+		databases[name] = db
+	}
+	return db
+}
+
+// lookupDatabase returns the database of the given name without creating it, so
+// reads don't bring back a dropped database
+func lookupDatabase(name string) (*memDatabase, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	db, ok := databases[name]
+	return db, ok
+}
+
+// dropDatabase removes a database, pending transactions on its tables fail to commit
+func dropDatabase(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	db, ok := databases[name]
+	if !ok {
+		return
+	}
+	for _, table := range db.tables {
+		table.dropped = true
+	}
+	db.sequenceTable.dropped = true
+	delete(databases, name)
+}
+
+// table returns the table of the given name
+func (db *memDatabase) table(name string) (*memTable, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	table, ok := db.tables[name]
+	return table, ok
+}
+
+// register creates the table of a model, replacing the existing one
+func (db *memDatabase) register(data interface{}) error {
+	odata, ok := data.(orm.DataModel)
+	if !ok {
+		return fmt.Errorf("object need to implements orm.datamodel")
+	}
+
+	mt := newMemTable()
+	mt.name = odata.TableName()
+	mt.model = reflect.TypeOf(data)
+	lock.Lock()
+	if old, ok := db.tables[mt.name]; ok {
+		old.dropped = true
+	}
+	db.tables[mt.name] = mt
+	lock.Unlock()
+	return nil
+}
+
+// ensureTable returns the table of the given name, creating it with model and
+// idField when it doesn't exist yet. A table without model is schemaless
+func (db *memDatabase) ensureTable(name string, model reflect.Type, idField string) *memTable {
+	lock.Lock()
+	defer lock.Unlock()
+	table, ok := db.tables[name]
+	if !ok {
+		table = newMemTable()
+		table.name = name
+		table.idField = idField
+		if idField == "" {
+			table.idField = DefaultIDField
+		}
+		db.tables[name] = table
+	}
+	if table.model == nil && model != nil {
+		table.model = model
+	}
+	return table
+}
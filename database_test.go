@@ -0,0 +1,92 @@
+package flexmem_test
+
+import (
+	"sort"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestDatabase(t *testing.T) {
+	convey.Convey("databases", t, func() {
+		connect := func(uri string) *flexmem.Connection {
+			conn, e := dbflex.NewConnectionFromURI(uri, nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(conn.Connect(), convey.ShouldBeNil)
+			return conn.(*flexmem.Connection)
+		}
+		conn1 := connect(flexmem.DriverName + "://localhost/testdb1")
+		defer conn1.Close()
+		conn2 := connect(flexmem.DriverName + "://localhost/testdb2")
+		defer conn2.Close()
+		defer conn1.DropDatabase()
+		defer conn2.DropDatabase()
+
+		convey.So(conn1.RegisterObject(new(Obj)), convey.ShouldBeNil)
+		convey.So(conn1.RegisterObject(new(Counter)), convey.ShouldBeNil)
+		convey.So(conn2.RegisterObject(new(Obj)), convey.ShouldBeNil)
+
+		count := func(conn dbflex.IConnection, table string) int {
+			cur := conn.Cursor(dbflex.From(table).Select(), nil)
+			defer cur.Close()
+			return cur.Count()
+		}
+
+		convey.Convey("tables are scoped to the database", func() {
+			names := conn1.ObjectNames(dbflex.ObjTypeTable)
+			sort.Strings(names)
+			convey.So(names, convey.ShouldResemble, []string{"counters", "objs"})
+			convey.So(conn2.ObjectNames(dbflex.ObjTypeTable), convey.ShouldResemble, []string{"objs"})
+			convey.So(conn2.HasTable("counters"), convey.ShouldBeFalse)
+
+			for i := 1; i <= 3; i++ {
+				_, e := conn1.Execute(dbflex.From("objs").Insert(), toolkit.M{}.Set("data", newObj("", i)))
+				convey.So(e, convey.ShouldBeNil)
+			}
+			_, e := conn2.Execute(dbflex.From("objs").Insert(), toolkit.M{}.Set("data", newObj("", 1)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count(conn1, "objs"), convey.ShouldEqual, 3)
+			convey.So(count(conn2, "objs"), convey.ShouldEqual, 1)
+
+			_, e = conn2.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: 1}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("connections share the database of the same name", func() {
+			conn3 := connect(flexmem.DriverName + "://localhost/testdb1")
+			defer conn3.Close()
+			_, e := conn1.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: 1}))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count(conn3, "counters"), convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("sequences are scoped to the database", func() {
+			for i := 0; i < 2; i++ {
+				_, e := conn1.NextSequence("tickets")
+				convey.So(e, convey.ShouldBeNil)
+			}
+			v, e := conn2.NextSequence("tickets")
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(v, convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("drop table and drop database", func() {
+			convey.So(conn2.DropTable("objs"), convey.ShouldBeNil)
+			convey.So(conn2.HasTable("objs"), convey.ShouldBeFalse)
+			convey.So(conn1.HasTable("objs"), convey.ShouldBeTrue)
+
+			convey.So(conn1.DropDatabase(), convey.ShouldBeNil)
+			convey.So(conn1.HasTable("objs"), convey.ShouldBeFalse)
+			convey.So(conn1.ObjectNames(dbflex.ObjTypeTable), convey.ShouldBeEmpty)
+			convey.So(conn1.Cursor(dbflex.From("objs").Select(), nil).Error(), convey.ShouldNotBeNil)
+			_, e := conn1.Execute(dbflex.From("objs").Delete(), nil)
+			convey.So(e, convey.ShouldNotBeNil)
+			convey.So(conn1.DropTable("objs"), convey.ShouldBeNil)
+			convey.So(conn1.EnsureSequence(flexmem.Sequence{Table: "objs"}), convey.ShouldNotBeNil)
+			convey.So(flexmem.HasDatabase("testdb1"), convey.ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,51 @@
+package flexmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VersionConflictError is returned when a record is written with an expected
+// version that is not the current version of the record anymore
+type VersionConflictError struct {
+	Table    string
+	Key      string
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %s with key '%s', expecting version %d but found %d",
+		e.Table, e.Key, e.Expected, e.Actual)
+}
+
+// IsVersionConflict returns true if err is or wraps a VersionConflictError
+func IsVersionConflict(err error) bool {
+	var ve *VersionConflictError
+	return errors.As(err, &ve)
+}
+
+// DuplicateKeyError is returned when a record is written with a key that is
+// already used by another record, or with a value of a unique index that
+// another record already has. Index is empty for the primary key
+type DuplicateKeyError struct {
+	Table    string
+	Index    string
+	Key      string
+	Existing string
+	Value    interface{}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	if e.Index == "" {
+		return fmt.Sprintf("record already exists with key '%s'", e.Key)
+	}
+	return fmt.Sprintf("duplicate value %v of unique index %s on %s for key '%s', already used by '%s'",
+		e.Value, e.Index, e.Table, e.Key, e.Existing)
+}
+
+// IsDuplicateKey returns true if err is or wraps a DuplicateKeyError
+func IsDuplicateKey(err error) bool {
+	var de *DuplicateKeyError
+	return errors.As(err, &de)
+}
@@ -0,0 +1,7 @@
+package flexmem
+
+// HasDatabase returns true when the database of the given name exists
+func HasDatabase(name string) bool {
+	_, ok := lookupDatabase(name)
+	return ok
+}
@@ -0,0 +1,523 @@
+package flexmem
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+)
+
+// Filter operators supported by flexmem on top of the ones defined by dbflex
+const (
+	// OpBetween matches values strictly between 2 bounds, while dbflex.OpRange
+	// includes both bounds
+	OpBetween dbflex.FilterOp = "$between"
+	// OpExists matches records that have (Value true) or don't have (Value false) the field
+	OpExists dbflex.FilterOp = "$exists"
+	// OpIsNull matches records where the field is missing or nil (Value true) or
+	// has a non nil value (Value false)
+	OpIsNull dbflex.FilterOp = "$isnull"
+	// OpRegex matches string values against a regular expression
+	OpRegex dbflex.FilterOp = "$regex"
+	// OpEqi, OpContainsi, OpStartWithi and OpEndWithi are the case insensitive
+	// variants of dbflex.OpEq, OpContains, OpStartWith and OpEndWith
+	OpEqi        dbflex.FilterOp = "$eqi"
+	OpContainsi  dbflex.FilterOp = "$containsi"
+	OpStartWithi dbflex.FilterOp = "$startwithi"
+	OpEndWithi   dbflex.FilterOp = "$endwithi"
+	// OpElemMatch matches array fields having at least 1 element matching the
+	// filter in Items, fields of that filter are relative to the element
+	OpElemMatch dbflex.FilterOp = "$elemmatch"
+	// OpSize matches array fields having exactly Value elements
+	OpSize dbflex.FilterOp = "$size"
+	// OpAll matches array fields containing all of the values
+	OpAll dbflex.FilterOp = "$all"
+)
+
+// Between creates filter for values strictly between from and to
+func Between(field string, from, to interface{}) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpBetween, Value: []interface{}{from, to}}
+}
+
+// Exists creates filter for records having the field
+func Exists(field string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpExists, Value: true}
+}
+
+// NotExists creates filter for records without the field
+func NotExists(field string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpExists, Value: false}
+}
+
+// IsNull creates filter for records where the field is missing or nil
+func IsNull(field string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpIsNull, Value: true}
+}
+
+// IsNotNull creates filter for records where the field has non nil value
+func IsNotNull(field string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpIsNull, Value: false}
+}
+
+// Regex creates filter for string values matching a regular expression
+func Regex(field string, pattern string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpRegex, Value: pattern}
+}
+
+// Eqi creates case insensitive equality filter
+func Eqi(field string, value string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpEqi, Value: value}
+}
+
+// Containsi creates case insensitive filter for string values containing any of values
+func Containsi(field string, values ...string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpContainsi, Value: values}
+}
+
+// StartWithi creates case insensitive filter for string values starting with value
+func StartWithi(field string, value string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpStartWithi, Value: value}
+}
+
+// EndWithi creates case insensitive filter for string values ending with value
+func EndWithi(field string, value string) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpEndWithi, Value: value}
+}
+
+// ElemMatch creates filter for array fields having an element matching f. Use
+// an empty field on f to match the element itself
+func ElemMatch(field string, f *dbflex.Filter) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpElemMatch, Items: []*dbflex.Filter{f}}
+}
+
+// Size creates filter for array fields having exactly n elements
+func Size(field string, n int) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpSize, Value: n}
+}
+
+// All creates filter for array fields containing all of the values
+func All(field string, values ...interface{}) *dbflex.Filter {
+	return &dbflex.Filter{Field: field, Op: OpAll, Value: values}
+}
+
+// MemFilterFunc is the predicate of a compiled filter
+type MemFilterFunc func(record interface{}) bool
+
+// memFilter is a node of a compiled filter tree. Every node keeps the filter it
+// is compiled from, so the tree can still be inspected after compilation
+type memFilter struct {
+	filter *dbflex.Filter
+	items  []*memFilter
+	fn     MemFilterFunc
+}
+
+// Match returns true if the record matches the filter
+func (mf *memFilter) Match(record interface{}) bool {
+	return mf.fn(record)
+}
+
+// scanFunc returns ScanFunc of the filter, nil filter returns nil ScanFunc which
+// matches every record
+func (mf *memFilter) scanFunc() ScanFunc {
+	if mf == nil {
+		return nil
+	}
+	return ScanFunc(func(k string, r interface{}) (bool, interface{}) {
+		if mf.Match(r) {
+			return true, r
+		}
+		return false, nil
+	})
+}
+
+// compileFilter compiles a dbflex.Filter of any depth into a filter tree
+func (qr *Query) compileFilter(f *dbflex.Filter) (*memFilter, error) {
+	if f == nil {
+		return nil, errors.New("filter is nil")
+	}
+
+	node := &memFilter{filter: f}
+	switch f.Op {
+	case dbflex.OpAnd, dbflex.OpOr, dbflex.OpNot, OpElemMatch:
+		if len(f.Items) == 0 {
+			return nil, fmt.Errorf("filter %s need at least 1 item", f.Op)
+		}
+		node.items = make([]*memFilter, len(f.Items))
+		for idx, item := range f.Items {
+			itemNode, e := qr.compileFilter(item)
+			if e != nil {
+				return nil, e
+			}
+			node.items[idx] = itemNode
+		}
+	}
+
+	fn, e := qr.buildFilterFunc(f, node.items)
+	if e != nil {
+		return nil, e
+	}
+	node.fn = fn
+	return node, nil
+}
+
+// buildFilterFunc builds the predicate of a filter node, items are the compiled
+// child nodes of logical operators
+func (qr *Query) buildFilterFunc(f *dbflex.Filter, items []*memFilter) (MemFilterFunc, error) {
+	fieldName := f.Field
+
+	switch f.Op {
+	case dbflex.OpAnd:
+		return MemFilterFunc(func(record interface{}) bool {
+			for _, item := range items {
+				if !item.fn(record) {
+					return false
+				}
+			}
+			return true
+		}), nil
+
+	case dbflex.OpOr:
+		return MemFilterFunc(func(record interface{}) bool {
+			for _, item := range items {
+				if item.fn(record) {
+					return true
+				}
+			}
+			return false
+		}), nil
+
+	case dbflex.OpNot:
+		if len(items) != 1 {
+			return nil, fmt.Errorf("filter %s need exactly 1 item", f.Op)
+		}
+		return MemFilterFunc(func(record interface{}) bool {
+			return !items[0].fn(record)
+		}), nil
+
+	case dbflex.OpEq:
+		return fieldFilter(fieldName, func(v interface{}) bool {
+			return equalValue(v, f.Value)
+		}), nil
+
+	case dbflex.OpNe:
+		return noneFilter(fieldName, func(v interface{}) bool {
+			return equalValue(v, f.Value)
+		}), nil
+
+	case dbflex.OpGt:
+		return compare(fieldName, string(f.Op), f.Value), nil
+
+	case dbflex.OpGte:
+		return compare(fieldName, string(f.Op), f.Value), nil
+
+	case dbflex.OpLt:
+		return compare(fieldName, string(f.Op), f.Value), nil
+
+	case dbflex.OpLte:
+		return compare(fieldName, string(f.Op), f.Value), nil
+
+	case dbflex.OpRange, OpBetween:
+		bounds := filterValues(f.Value)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("filter %s on %s need 2 values", f.Op, fieldName)
+		}
+		fromOp, toOp := "$gte", "$lte"
+		if f.Op == OpBetween {
+			fromOp, toOp = "$gt", "$lt"
+		}
+		return fieldFilter(fieldName, func(v interface{}) bool {
+			return toolkit.Compare(v, bounds[0], fromOp) && toolkit.Compare(v, bounds[1], toOp)
+		}), nil
+
+	case dbflex.OpIn:
+		values := filterValues(f.Value)
+		return fieldFilter(fieldName, func(v interface{}) bool {
+			return inValues(v, values)
+		}), nil
+
+	case dbflex.OpNin:
+		values := filterValues(f.Value)
+		return noneFilter(fieldName, func(v interface{}) bool {
+			return inValues(v, values)
+		}), nil
+
+	case dbflex.OpContains, OpContainsi:
+		return stringsFilter(fieldName, f.Op == OpContainsi, f.Value, strings.Contains), nil
+
+	case dbflex.OpStartWith, OpStartWithi:
+		return stringsFilter(fieldName, f.Op == OpStartWithi, f.Value, strings.HasPrefix), nil
+
+	case dbflex.OpEndWith, OpEndWithi:
+		return stringsFilter(fieldName, f.Op == OpEndWithi, f.Value, strings.HasSuffix), nil
+
+	case OpEqi:
+		value := strings.ToLower(fmt.Sprintf("%v", f.Value))
+		return stringFilter(fieldName, func(v string) bool {
+			return strings.ToLower(v) == value
+		}), nil
+
+	case OpRegex:
+		rx, e := qr.regex(f.Value)
+		if e != nil {
+			return nil, fmt.Errorf("filter %s on %s: %s", f.Op, fieldName, e.Error())
+		}
+		return stringFilter(fieldName, rx.MatchString), nil
+
+	case OpElemMatch:
+		if len(items) != 1 {
+			return nil, fmt.Errorf("filter %s need exactly 1 item", f.Op)
+		}
+		return MemFilterFunc(func(record interface{}) bool {
+			v, e := getFieldValue(record, fieldName)
+			if e != nil {
+				return false
+			}
+			elems, isArray := arrayElements(v)
+			if !isArray {
+				return false
+			}
+			for _, elem := range elems {
+				if items[0].fn(elem) {
+					return true
+				}
+			}
+			return false
+		}), nil
+
+	case OpSize:
+		size, ok := toInt64(f.Value)
+		if !ok {
+			return nil, fmt.Errorf("filter %s on %s need an integer value", f.Op, fieldName)
+		}
+		return MemFilterFunc(func(record interface{}) bool {
+			v, e := getFieldValue(record, fieldName)
+			if e != nil {
+				return false
+			}
+			elems, isArray := arrayElements(v)
+			return isArray && int64(len(elems)) == size
+		}), nil
+
+	case OpAll:
+		values := filterValues(f.Value)
+		return MemFilterFunc(func(record interface{}) bool {
+			v, e := getFieldValue(record, fieldName)
+			if e != nil {
+				return false
+			}
+			for _, value := range values {
+				if !anyValue(v, func(elem interface{}) bool {
+					return equalValue(elem, value)
+				}) {
+					return false
+				}
+			}
+			return true
+		}), nil
+
+	case OpExists:
+		exists, ok := f.Value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("filter %s on %s need a bool value", f.Op, fieldName)
+		}
+		return MemFilterFunc(func(record interface{}) bool {
+			_, e := getFieldValue(record, fieldName)
+			return (e == nil) == exists
+		}), nil
+
+	case OpIsNull:
+		isNull, ok := f.Value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("filter %s on %s need a bool value", f.Op, fieldName)
+		}
+		return MemFilterFunc(func(record interface{}) bool {
+			v, e := getFieldValue(record, fieldName)
+			return (e != nil || isNilValue(v)) == isNull
+		}), nil
+	}
+
+	return nil, fmt.Errorf("filter operator %s is not supported", f.Op)
+}
+
+// fieldFilter creates filter func that matches records where fn returns true for
+// the value of the field or, for array fields, for any of its elements. Records
+// without the field never match
+func fieldFilter(fieldName string, fn func(v interface{}) bool) MemFilterFunc {
+	return MemFilterFunc(func(record interface{}) bool {
+		v, e := getFieldValue(record, fieldName)
+		if e != nil {
+			return false
+		}
+		return anyValue(v, fn)
+	})
+}
+
+// noneFilter is the negation of fieldFilter, except that records without the
+// field still never match
+func noneFilter(fieldName string, fn func(v interface{}) bool) MemFilterFunc {
+	return MemFilterFunc(func(record interface{}) bool {
+		v, e := getFieldValue(record, fieldName)
+		if e != nil {
+			return false
+		}
+		return !anyValue(v, fn)
+	})
+}
+
+// anyValue returns true if fn is true for v or for any element of v when v is an array
+func anyValue(v interface{}, fn func(v interface{}) bool) bool {
+	if fn(v) {
+		return true
+	}
+	elems, isArray := arrayElements(v)
+	if !isArray {
+		return false
+	}
+	for _, elem := range elems {
+		if fn(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// arrayElements returns elements of slice and array values, []byte is not
+// considered as an array
+func arrayElements(v interface{}) ([]interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	if rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	res := make([]interface{}, rv.Len())
+	for i := range res {
+		res[i] = rv.Index(i).Interface()
+	}
+	return res, true
+}
+
+// stringFilter is a fieldFilter that only matches string values
+func stringFilter(fieldName string, fn func(v string) bool) MemFilterFunc {
+	return fieldFilter(fieldName, func(v interface{}) bool {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.String {
+			return false
+		}
+		return fn(rv.String())
+	})
+}
+
+// stringsFilter is a stringFilter matching when fn returns true for any of the
+// filter values
+func stringsFilter(fieldName string, insensitive bool, value interface{}, fn func(s, value string) bool) MemFilterFunc {
+	values := filterStrings(value)
+	if insensitive {
+		for idx, v := range values {
+			values[idx] = strings.ToLower(v)
+		}
+	}
+	return stringFilter(fieldName, func(v string) bool {
+		if insensitive {
+			v = strings.ToLower(v)
+		}
+		for _, value := range values {
+			if fn(v, value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// regex returns compiled regular expression of a filter value. Expressions are
+// compiled once per query
+func (qr *Query) regex(value interface{}) (*regexp.Regexp, error) {
+	switch v := value.(type) {
+	case *regexp.Regexp:
+		return v, nil
+
+	case string:
+		if rx, ok := qr.regexes[v]; ok {
+			return rx, nil
+		}
+		rx, e := regexp.Compile(v)
+		if e != nil {
+			return nil, e
+		}
+		if qr.regexes == nil {
+			qr.regexes = map[string]*regexp.Regexp{}
+		}
+		qr.regexes[v] = rx
+		return rx, nil
+	}
+	return nil, fmt.Errorf("invalid regular expression %v", value)
+}
+
+func compare(fieldName, op string, value interface{}) MemFilterFunc {
+	return fieldFilter(fieldName, func(v interface{}) bool {
+		return toolkit.Compare(v, value, op)
+	})
+}
+
+// filterValues returns the items of a filter value, or the value itself as the
+// only item if it is not a slice
+func filterValues(value interface{}) []interface{} {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []interface{}{value}
+	}
+	res := make([]interface{}, rv.Len())
+	for i := range res {
+		res[i] = rv.Index(i).Interface()
+	}
+	return res
+}
+
+func filterStrings(value interface{}) []string {
+	values := filterValues(value)
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			res = append(res, s)
+		} else {
+			res = append(res, fmt.Sprintf("%v", v))
+		}
+	}
+	return res
+}
+
+// equalValue compares 2 values, numbers of different types are equal when they
+// have the same value
+func equalValue(a, b interface{}) bool {
+	if valueKind(reflect.ValueOf(a)) == kindOther || valueKind(reflect.ValueOf(b)) == kindOther {
+		return reflect.DeepEqual(a, b)
+	}
+	return compareValue(a, b) == 0
+}
+
+func inValues(v interface{}, values []interface{}) bool {
+	for _, value := range values {
+		if equalValue(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNilValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package flexmem_test
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func prepareFilterData(conn dbflex.IConnection) {
+	for i := 1; i <= testCount; i++ {
+		obj := newObj(fmt.Sprintf("filter-%03d", i), randSeed)
+		obj.Index = i
+		obj.Seed = i % 10
+		conn.Execute(dbflex.From(obj.TableName()).Insert(), toolkit.M{}.Set("data", obj))
+	}
+}
+
+func countWhere(conn dbflex.IConnection, f *dbflex.Filter) (int, error) {
+	cr := conn.Cursor(dbflex.From(new(Obj).TableName()).Where(f).Select(), nil)
+	if e := cr.Error(); e != nil {
+		return 0, e
+	}
+	defer cr.Close()
+	return cr.Count(), nil
+}
+
+func TestFilterOperators(t *testing.T) {
+	t.Parallel()
+	convey.Convey("filter operators", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		prepareFilterData(conn)
+
+		cases := []struct {
+			filter *dbflex.Filter
+			count  int
+		}{
+			{dbflex.Eq("Seed", 3), testCount / 10},
+			{dbflex.Eq("Seed", int64(3)), testCount / 10},
+			{dbflex.Ne("Seed", 3), testCount - testCount/10},
+			{dbflex.In("Seed", 1, 2, 3), 3 * testCount / 10},
+			{dbflex.Nin("Seed", 1, 2, 3), testCount - 3*testCount/10},
+			{dbflex.Not(dbflex.Lte("Index", 10)), testCount - 10},
+			{dbflex.Contains("ID", "-01"), 10},
+			{dbflex.StartWith("Name", "Name filter-00"), 9},
+			{dbflex.EndWith("ID", "0"), testCount / 10},
+			{dbflex.Range("Index", 10, 20), 11},
+			{flexmem.Between("Index", 10, 20), 9},
+			{flexmem.Exists("Seed"), testCount},
+			{flexmem.NotExists("Unknown"), testCount},
+			{flexmem.IsNull("Unknown"), testCount},
+			{flexmem.IsNotNull("Name"), testCount},
+			{flexmem.Regex("ID", `^filter-0[0-4]\d$`), 49},
+			{flexmem.Regex("ID", `^FILTER`), 0},
+			{flexmem.Regex("ID", `(?i)^FILTER`), testCount},
+			{flexmem.Eqi("ID", "FILTER-001"), 1},
+			{flexmem.Containsi("Name", "NAME FILTER-01"), 10},
+			{flexmem.StartWithi("ID", "Filter-00"), 9},
+			{flexmem.EndWithi("Name", "R-100"), 1},
+		}
+		for _, c := range cases {
+			count, e := countWhere(conn, c.filter)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, c.count)
+		}
+
+		convey.Convey("invalid regex", func() {
+			_, e := countWhere(conn, flexmem.Regex("ID", "(filter"))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("unsupported operator", func() {
+			_, e := countWhere(conn, &dbflex.Filter{Field: "Seed", Op: "$unknown", Value: 1})
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestNestedFilter(t *testing.T) {
+	t.Parallel()
+	convey.Convey("nested filter", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		prepareFilterData(conn)
+
+		convey.Convey("and / or", func() {
+			count, e := countWhere(conn, dbflex.And(dbflex.Gt("Index", 10), dbflex.Lte("Index", 20)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, 10)
+
+			count, e = countWhere(conn, dbflex.Or(dbflex.Eq("Index", 1), dbflex.Eq("Index", 2), dbflex.Eq("Index", 200)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("deep nesting", func() {
+			// (Index <= 50 and (Seed = 1 or Seed = 2 or not(Index > 5))) or (Index > 90 and not(Seed in [0, 9]))
+			f := dbflex.Or(
+				dbflex.And(
+					dbflex.Lte("Index", 50),
+					dbflex.Or(
+						dbflex.Eq("Seed", 1),
+						dbflex.Eq("Seed", 2),
+						dbflex.Not(dbflex.Gt("Index", 5)))),
+				dbflex.And(
+					dbflex.Gt("Index", 90),
+					dbflex.Not(dbflex.In("Seed", 0, 9))))
+			count, e := countWhere(conn, f)
+			convey.So(e, convey.ShouldBeNil)
+			// 10 for Seed 1 or 2 up to 50, plus 3, 4, 5, plus 91..98
+			convey.So(count, convey.ShouldEqual, 10+3+8)
+
+			depth := 50
+			f = dbflex.Eq("Index", 42)
+			for i := 0; i < depth; i++ {
+				if i%2 == 0 {
+					f = dbflex.And(f, dbflex.Gt("Index", 0))
+				} else {
+					f = dbflex.Or(f, dbflex.Eq("Index", -1))
+				}
+			}
+			count, e = countWhere(conn, f)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("invalid item", func() {
+			_, e := countWhere(conn, dbflex.And(dbflex.Eq("Index", 1), dbflex.Or(&dbflex.Filter{Field: "Seed", Op: "$unknown"})))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestArrayFilter(t *testing.T) {
+	t.Parallel()
+	convey.Convey("array filter", t, func() {
+		conn := flexmemtest.New(t, new(Order))
+		tableName := new(Order).TableName()
+
+		tags := [][]string{{"red"}, {"red", "blue"}, {"red", "blue", "green"}, {}}
+		for i := 0; i < 20; i++ {
+			order := &Order{
+				ID:    fmt.Sprintf("order-%d", i),
+				Items: []OrderItem{{Qty: i}, {Qty: i + 100}},
+				Tags:  tags[i%4],
+			}
+			conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", order))
+		}
+
+		cases := []struct {
+			filter *dbflex.Filter
+			count  int
+		}{
+			{dbflex.Eq("Tags", "blue"), 10},
+			{dbflex.Ne("Tags", "blue"), 10},
+			{dbflex.In("Tags", "green", "yellow"), 5},
+			{dbflex.Nin("Tags", "red"), 5},
+			{dbflex.StartWith("Tags", "gr"), 5},
+			{dbflex.Gte("Items.Qty", 115), 5},
+			{flexmem.ElemMatch("Items", dbflex.And(dbflex.Gt("Qty", 5), dbflex.Lt("Qty", 10))), 4},
+			{flexmem.ElemMatch("Tags", dbflex.Eq("", "green")), 5},
+			{flexmem.Size("Tags", 2), 5},
+			{flexmem.Size("Tags", 0), 5},
+			{flexmem.All("Tags", "red", "blue"), 10},
+			{flexmem.All("Tags", "red", "yellow"), 0},
+		}
+		for _, c := range cases {
+			cr := conn.Cursor(dbflex.From(tableName).Where(c.filter).Select(), nil)
+			convey.So(cr.Error(), convey.ShouldBeNil)
+			convey.So(cr.Count(), convey.ShouldEqual, c.count)
+			cr.Close()
+		}
+	})
+}
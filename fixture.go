@@ -0,0 +1,262 @@
+package flexmem
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+	"git.kanosolution.net/kano/dbflex/orm"
+	"github.com/eaciit/toolkit"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FixtureName is the key of a fixture record holding its name, the name is
+	// not stored and only used to refer to the record
+	FixtureName = "$name"
+
+	// FixtureRef prefixes a string value referring to the ID of another fixture
+	// record, eg "$ref:customers.alice"
+	FixtureRef = "$ref:"
+)
+
+// Fixtures are the records inserted by LoadFixtures
+type Fixtures struct {
+	records map[string]map[string]fixtureRecord
+}
+
+type fixtureRecord struct {
+	id   interface{}
+	data interface{}
+}
+
+// ID returns the ID of a named fixture record
+func (fx *Fixtures) ID(tableName, name string) interface{} {
+	return fx.records[tableName][name].id
+}
+
+// Record returns the inserted record of a named fixture record
+func (fx *Fixtures) Record(tableName, name string) interface{} {
+	return fx.records[tableName][name].data
+}
+
+type fixture struct {
+	table string
+	name  string
+	doc   map[string]interface{}
+}
+
+// LoadFixtures inserts the records of JSON or YAML files into the tables of the
+// connection. A file holding an array has the records of the table named after
+// the file, eg customers.yaml, while a file holding an object has the records of
+// each of its table keys.
+//
+// Records are decoded into the model of their table, or kept as toolkit.M for
+// schemaless tables. A record named by FixtureName can be referred to by other
+// records with a FixtureRef value, which is replaced by the ID of the referred
+// record once it is inserted, so IDs generated on insert can be referred to
+func (conn *Connection) LoadFixtures(paths ...string) (*Fixtures, error) {
+	fixtures := []*fixture{}
+	for _, path := range paths {
+		fileFixtures, e := readFixtureFile(path)
+		if e != nil {
+			return nil, e
+		}
+		fixtures = append(fixtures, fileFixtures...)
+	}
+
+	fx := &Fixtures{records: map[string]map[string]fixtureRecord{}}
+	for _, f := range fixtures {
+		if f.name == "" {
+			continue
+		}
+		if _, exist := fx.records[f.table][f.name]; exist {
+			return nil, fmt.Errorf("fixture %s.%s is duplicated", f.table, f.name)
+		}
+		if fx.records[f.table] == nil {
+			fx.records[f.table] = map[string]fixtureRecord{}
+		}
+		fx.records[f.table][f.name] = fixtureRecord{}
+	}
+
+	//-- records are inserted once the records they refer to have been inserted
+	for len(fixtures) > 0 {
+		pending := []*fixture{}
+		for _, f := range fixtures {
+			doc, ready, e := fx.resolve(f.doc)
+			if e != nil {
+				return nil, fmt.Errorf("fixture of %s. %s", f.table, e.Error())
+			}
+			if !ready {
+				pending = append(pending, f)
+				continue
+			}
+			if e = conn.insertFixture(fx, f, doc.(map[string]interface{})); e != nil {
+				return nil, e
+			}
+		}
+		if len(pending) == len(fixtures) {
+			return nil, fmt.Errorf("fixture of %s has circular references", pending[0].table)
+		}
+		fixtures = pending
+	}
+	return fx, nil
+}
+
+func (conn *Connection) insertFixture(fx *Fixtures, f *fixture, doc map[string]interface{}) error {
+	table, ok := conn.table(f.table)
+	var model reflect.Type
+	if ok {
+		lock.RLock()
+		model = table.model
+		lock.RUnlock()
+	}
+
+	var data interface{} = toolkit.M(doc)
+	if model != nil {
+		if model.Kind() != reflect.Ptr {
+			return fmt.Errorf("table %s has no registered model", f.table)
+		}
+		bs, e := json.Marshal(doc)
+		if e != nil {
+			return fmt.Errorf("error encoding fixture of %s. %s", f.table, e.Error())
+		}
+		data = reflect.New(model.Elem()).Interface()
+		if e = json.Unmarshal(bs, data); e != nil {
+			return fmt.Errorf("error decoding fixture of %s into %v. %s", f.table, model, e.Error())
+		}
+	}
+
+	if _, e := conn.Execute(dbflex.From(f.table).Insert(), toolkit.M{}.Set("data", data)); e != nil {
+		return fmt.Errorf("error inserting fixture of %s. %s", f.table, e.Error())
+	}
+	if f.name == "" {
+		return nil
+	}
+
+	var ids []interface{}
+	if odata, ok := data.(orm.DataModel); ok {
+		_, ids = odata.GetID(conn)
+	} else if table, ok = conn.table(f.table); ok {
+		ids = []interface{}{doc[table.idField]}
+	}
+	rec := fixtureRecord{data: data}
+	if len(ids) == 1 {
+		rec.id = ids[0]
+	} else {
+		rec.id = ids
+	}
+	fx.records[f.table][f.name] = rec
+	return nil
+}
+
+// resolve replaces the references of a fixture value by the IDs of the referred
+// records, it returns false when a referred record has not been inserted yet
+func (fx *Fixtures) resolve(v interface{}) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.HasPrefix(v, FixtureRef) {
+			return v, true, nil
+		}
+		ref := strings.TrimPrefix(v, FixtureRef)
+		parts := strings.SplitN(ref, ".", 2)
+		if len(parts) != 2 {
+			return nil, false, fmt.Errorf("invalid reference %s", v)
+		}
+		rec, ok := fx.records[parts[0]][parts[1]]
+		if !ok {
+			return nil, false, fmt.Errorf("reference %s is not found", v)
+		}
+		if rec.data == nil {
+			return nil, false, nil
+		}
+		return rec.id, true, nil
+
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			rv, ready, e := fx.resolve(item)
+			if e != nil || !ready {
+				return nil, ready, e
+			}
+			res[k] = rv
+		}
+		return res, true, nil
+
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			rv, ready, e := fx.resolve(item)
+			if e != nil || !ready {
+				return nil, ready, e
+			}
+			res[i] = rv
+		}
+		return res, true, nil
+	}
+	return v, true, nil
+}
+
+func readFixtureFile(path string) ([]*fixture, error) {
+	bs, e := os.ReadFile(path)
+	if e != nil {
+		return nil, fmt.Errorf("error reading fixture %s. %s", path, e.Error())
+	}
+
+	var content interface{}
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".json":
+		e = json.Unmarshal(bs, &content)
+	case ".yaml", ".yml":
+		e = yaml.Unmarshal(bs, &content)
+	default:
+		return nil, fmt.Errorf("fixture %s is neither json nor yaml", path)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("error decoding fixture %s. %s", path, e.Error())
+	}
+
+	tableRecords := map[string]interface{}{}
+	tableNames := []string{}
+	switch content := content.(type) {
+	case []interface{}:
+		tableName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		tableRecords[tableName] = content
+		tableNames = append(tableNames, tableName)
+	case map[string]interface{}:
+		tableRecords = content
+		for tableName := range content {
+			tableNames = append(tableNames, tableName)
+		}
+		sort.Strings(tableNames)
+	default:
+		return nil, fmt.Errorf("fixture %s should hold an array or an object of tables", path)
+	}
+
+	res := []*fixture{}
+	for _, tableName := range tableNames {
+		records, ok := tableRecords[tableName].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("fixture %s should hold an array of records for %s", path, tableName)
+		}
+		for _, record := range records {
+			doc, ok := record.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("fixture %s has an invalid record of %s: %v", path, tableName, record)
+			}
+			f := &fixture{table: tableName, doc: doc}
+			if name, ok := doc[FixtureName]; ok {
+				f.name = fmt.Sprint(name)
+				delete(doc, FixtureName)
+			}
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,122 @@
+package flexmem_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.kanosolution.net/kano/dbflex"
+	"git.kanosolution.net/kano/dbflex/orm"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+type Customer struct {
+	orm.DataModelBase
+	ID         string
+	Name       string
+	ReferrerID string
+	Since      time.Time
+}
+
+func (o *Customer) TableName() string {
+	return "customers"
+}
+
+func (o *Customer) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Customer) SetID(keys ...interface{}) {
+	o.ID = keys[0].(string)
+}
+
+type InvoiceLine struct {
+	Item string
+	Qty  int
+}
+
+type Invoice struct {
+	orm.DataModelBase
+	ID         int
+	CustomerID string
+	Lines      []InvoiceLine
+	Total      float64
+}
+
+func (o *Invoice) TableName() string {
+	return "invoices"
+}
+
+func (o *Invoice) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Invoice) SetID(keys ...interface{}) {
+	o.ID = keys[0].(int)
+}
+
+func TestFixtures(t *testing.T) {
+	t.Parallel()
+	convey.Convey("fixtures", t, func() {
+		conn := flexmemtest.NewWithConfig(t, toolkit.M{}.Set(flexmem.ConfigAutoCreate, true), new(Customer), new(Invoice))
+		convey.So(conn.SetTableIDGenerator("invoices", flexmem.SequentialGenerator(1)), convey.ShouldBeNil)
+
+		convey.Convey("one file per table", func() {
+			fx, e := conn.LoadFixtures("testdata/fixtures/customers.yaml", "testdata/fixtures/invoices.json")
+			convey.So(e, convey.ShouldBeNil)
+
+			alice := fx.Record("customers", "alice").(*Customer)
+			convey.So(len(alice.ID), convey.ShouldEqual, 24)
+			convey.So(fx.ID("customers", "alice"), convey.ShouldEqual, alice.ID)
+			convey.So(alice.Since.Equal(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)), convey.ShouldBeTrue)
+			convey.So(fx.Record("customers", "bob").(*Customer).ReferrerID, convey.ShouldEqual, alice.ID)
+			convey.So(fx.ID("invoices", "first"), convey.ShouldEqual, 1)
+
+			invoices := []Invoice{}
+			e = conn.Cursor(dbflex.From("invoices").OrderBy("ID").Select(), nil).Fetchs(&invoices, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(invoices), convey.ShouldEqual, 2)
+			convey.So(invoices[0].CustomerID, convey.ShouldEqual, alice.ID)
+			convey.So(invoices[0].Lines, convey.ShouldResemble, []InvoiceLine{{"pen", 2}, {"ink", 1}})
+			convey.So(invoices[0].Total, convey.ShouldEqual, 12.5)
+			convey.So(invoices[1].CustomerID, convey.ShouldEqual, fx.ID("customers", "bob"))
+		})
+
+		convey.Convey("combined file", func() {
+			fx, e := conn.LoadFixtures("testdata/fixtures/combined.yaml")
+			convey.So(e, convey.ShouldBeNil)
+			carol := fx.ID("customers", "carol")
+			convey.So(fx.Record("customers", "dave").(*Customer).ReferrerID, convey.ShouldEqual, carol)
+
+			event := toolkit.M{}
+			e = conn.Cursor(dbflex.From("events").Select(), nil).Fetch(&event).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(event["Customer"], convey.ShouldEqual, carol)
+			convey.So(event["Tags"], convey.ShouldResemble, []interface{}{"web", "promo"})
+		})
+
+		convey.Convey("invalid fixtures", func() {
+			dir := t.TempDir()
+			write := func(name, content string) string {
+				path := filepath.Join(dir, name)
+				convey.So(os.WriteFile(path, []byte(content), 0644), convey.ShouldBeNil)
+				return path
+			}
+
+			_, e := conn.LoadFixtures(write("customers.json", `[{"Name": "Eve", "ReferrerID": "$ref:customers.mallory"}]`))
+			convey.So(e, convey.ShouldNotBeNil)
+			_, e = conn.LoadFixtures(write("loop.json", `{"customers": [
+				{"$name": "a", "ReferrerID": "$ref:customers.b"},
+				{"$name": "b", "ReferrerID": "$ref:customers.a"}]}`))
+			convey.So(e, convey.ShouldNotBeNil)
+			_, e = conn.LoadFixtures(write("customers.csv", "Name\nEve"))
+			convey.So(e, convey.ShouldNotBeNil)
+			_, e = conn.LoadFixtures(write("invoices.json", `[{"Total": "free"}]`))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
@@ -1,43 +1,64 @@
 package flexmem
 
 import (
-	"fmt"
 	"sync"
 
 	"git.kanosolution.net/kano/dbflex"
-	"git.kanosolution.net/kano/dbflex/orm"
 )
 
 var (
-	lock   *sync.RWMutex
-	tables map[string]*memTable
+	lock      *sync.RWMutex
+	databases map[string]*memDatabase
+	clock     *memClock
 )
 
 const (
 	DriverName = "flexmem"
+
+	// ParmVersion is the Execute parameter holding the expected version of the
+	// records to be updated or deleted
+	ParmVersion = "version"
+
+	// ParmOps is the Execute parameter holding the UpdateOp to be applied by an
+	// update or a save
+	ParmOps = "ops"
+
+	// ParmUpsert is the Execute parameter that makes an update insert a record when
+	// no record matches its filter
+	ParmUpsert = "upsert"
+
+	// ParmReturnRecords is the Execute parameter that makes an update return the
+	// updated records in UpdateResult
+	ParmReturnRecords = "returnrecords"
+
+	// ConfigAutoCreate is the connection config that enables the auto create mode,
+	// where a missing table is created by its first insert, save or upsert
+	ConfigAutoCreate = "autocreate"
+
+	// ConfigIDField is the connection config holding the ID field of documents of
+	// schemaless tables created in auto create mode, it defaults to DefaultIDField
+	ConfigIDField = "idfield"
+
+	DefaultIDField = "_id"
 )
 
 func init() {
 	//=== sample: text://localhost?path=/usr/local/txt
 	lock = new(sync.RWMutex)
-	tables = make(map[string]*memTable)
+	databases = make(map[string]*memDatabase)
+	clock = newMemClock()
 
 	dbflex.RegisterDriver(DriverName, func(si *dbflex.ServerInfo) dbflex.IConnection {
 		c := new(Connection)
+		c.ServerInfo = *si
 		return c.SetThis(c)
 	})
 
 	//fmt.Println("driver", DriverName, "has been registered successfully")
 }
 
+// RegisterObject creates the table of a model in the default database, which is
+// used by connections without database in their URI
 func RegisterObject(data interface{}) error {
-	odata, ok := data.(orm.DataModel)
-	if !ok {
-		return fmt.Errorf("object need to implements orm.datamodel")
-	}
-
-	mt := newMemTable()
-	mt.name = odata.TableName()
-	tables[mt.name] = mt
-	return nil
+	return getDatabase("").register(data)
 }
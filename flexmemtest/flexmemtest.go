@@ -0,0 +1,89 @@
+// Package flexmemtest provides flexmem databases for tests. Every test gets its own
+// database, so tests using it can run in parallel
+package flexmemtest
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode"
+
+	"git.kanosolution.net/kano/dbflex"
+	"git.kanosolution.net/kano/dbflex/orm"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+)
+
+var dbCount int64
+
+// New returns a connection to a new database used only by t, with the tables of
+// the given models registered. The database is dropped when t completes
+func New(t testing.TB, models ...orm.DataModel) *flexmem.Connection {
+	return NewWithConfig(t, nil, models...)
+}
+
+// NewWithConfig is New with a connection config, eg flexmem.ConfigAutoCreate
+func NewWithConfig(t testing.TB, config toolkit.M, models ...orm.DataModel) *flexmem.Connection {
+	t.Helper()
+
+	uri := fmt.Sprintf("%s://localhost/%s", flexmem.DriverName, DatabaseName(t))
+	iconn, e := dbflex.NewConnectionFromURI(uri, config)
+	if e != nil {
+		t.Fatalf("error creating connection. %s", e.Error())
+	}
+	conn := iconn.(*flexmem.Connection)
+	if e = conn.Connect(); e != nil {
+		t.Fatalf("error connecting to %s. %s", uri, e.Error())
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		conn.DropDatabase()
+	})
+
+	for _, model := range models {
+		if e = conn.RegisterObject(model); e != nil {
+			t.Fatalf("error registering %T. %s", model, e.Error())
+		}
+	}
+	return conn
+}
+
+// Connect returns another connection to the database of conn, closed when t completes
+func Connect(t testing.TB, conn *flexmem.Connection) *flexmem.Connection {
+	t.Helper()
+
+	uri := fmt.Sprintf("%s://localhost/%s", flexmem.DriverName, conn.Database)
+	iconn, e := dbflex.NewConnectionFromURI(uri, conn.Config)
+	if e != nil {
+		t.Fatalf("error creating connection. %s", e.Error())
+	}
+	other := iconn.(*flexmem.Connection)
+	if e = other.Connect(); e != nil {
+		t.Fatalf("error connecting to %s. %s", uri, e.Error())
+	}
+	t.Cleanup(other.Close)
+	return other
+}
+
+// DatabaseName returns a unique database name for t, made of the test name and
+// a counter
+func DatabaseName(t testing.TB) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, t.Name())
+	return fmt.Sprintf("%s_%d", name, atomic.AddInt64(&dbCount, 1))
+}
+
+// LoadFixtures loads fixture files into the database of conn, failing t on error
+func LoadFixtures(t testing.TB, conn *flexmem.Connection, paths ...string) *flexmem.Fixtures {
+	t.Helper()
+	fx, e := conn.LoadFixtures(paths...)
+	if e != nil {
+		t.Fatalf("error loading fixtures. %s", e.Error())
+	}
+	return fx
+}
@@ -0,0 +1,69 @@
+package flexmemtest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"git.kanosolution.net/kano/dbflex/orm"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+type Item struct {
+	orm.DataModelBase
+	ID   string
+	Name string
+}
+
+func (o *Item) TableName() string {
+	return "items"
+}
+
+func (o *Item) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Item) SetID(keys ...interface{}) {
+	o.ID = keys[0].(string)
+}
+
+func TestNew(t *testing.T) {
+	var dropped *flexmem.Connection
+	t.Run("isolated", func(t *testing.T) {
+		for i := 1; i <= 5; i++ {
+			count := i
+			t.Run(fmt.Sprintf("count %d", count), func(t *testing.T) {
+				t.Parallel()
+				conn := flexmemtest.New(t, new(Item))
+				if count == 1 {
+					dropped = conn
+				}
+				for j := 1; j <= count; j++ {
+					item := &Item{ID: fmt.Sprintf("item-%d", j)}
+					if _, e := conn.Execute(dbflex.From("items").Insert(), toolkit.M{}.Set("data", item)); e != nil {
+						t.Fatal(e)
+					}
+				}
+				cur := conn.Cursor(dbflex.From("items").Select(), nil)
+				defer cur.Close()
+				if cur.Count() != count {
+					t.Fatalf("expected %d items, got %d", count, cur.Count())
+				}
+			})
+		}
+	})
+
+	convey.Convey("ephemeral database", t, func() {
+		convey.So(dropped.HasTable("items"), convey.ShouldBeFalse)
+
+		conn := flexmemtest.NewWithConfig(t, toolkit.M{}.Set(flexmem.ConfigAutoCreate, true))
+		_, e := conn.Execute(dbflex.From("notes").Insert(), toolkit.M{}.Set("data", toolkit.M{"Text": "hello"}))
+		convey.So(e, convey.ShouldBeNil)
+		convey.So(conn.ObjectNames(dbflex.ObjTypeTable), convey.ShouldResemble, []string{"notes"})
+
+		convey.So(flexmemtest.DatabaseName(t), convey.ShouldNotEqual, flexmemtest.DatabaseName(t))
+	})
+}
@@ -0,0 +1,125 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IDGenerator returns a new ID for a record inserted into a table with an empty
+// ID, current is the empty ID of the record. The returned value is converted to
+// the type of the ID field, eg an ObjectID or a UUID is formatted for string IDs
+type IDGenerator func(tableName string, current interface{}) (interface{}, error)
+
+// ObjectIDGenerator generates mongo ObjectIDs, it is the default generator
+func ObjectIDGenerator() IDGenerator {
+	return func(_ string, _ interface{}) (interface{}, error) {
+		return primitive.NewObjectID(), nil
+	}
+}
+
+// UUIDv4Generator generates random UUIDs
+func UUIDv4Generator() IDGenerator {
+	return func(_ string, _ interface{}) (interface{}, error) {
+		return uuid.NewRandom()
+	}
+}
+
+// UUIDv7Generator generates time ordered UUIDs
+func UUIDv7Generator() IDGenerator {
+	return func(_ string, _ interface{}) (interface{}, error) {
+		return uuid.NewV7()
+	}
+}
+
+// SequentialGenerator generates integers starting from start, with a separate
+// sequence for each table
+func SequentialGenerator(start int64) IDGenerator {
+	mtx := new(sync.Mutex)
+	next := map[string]int64{}
+	return func(tableName string, _ interface{}) (interface{}, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		id, ok := next[tableName]
+		if !ok {
+			id = start
+		}
+		next[tableName] = id + 1
+		return id, nil
+	}
+}
+
+var objectIDType = reflect.TypeOf(primitive.ObjectID{})
+
+// generateID returns a new ID of the same type as the given one using gen, or
+// ObjectIDGenerator when gen is nil. A nil ID, like the missing ID of a document,
+// takes the generated value as is. Composite IDs can't be generated
+func generateID(gen IDGenerator, tableName string, ids []interface{}) ([]interface{}, error) {
+	if len(ids) != 1 {
+		return nil, fmt.Errorf("composite id %v can't be generated", ids)
+	}
+
+	if gen == nil {
+		gen = ObjectIDGenerator()
+	}
+	v, e := gen(tableName, ids[0])
+	if e != nil {
+		return nil, fmt.Errorf("error generating id for %s. %s", tableName, e.Error())
+	}
+	if ids[0] == nil {
+		if v == nil {
+			return nil, fmt.Errorf("generated id is nil")
+		}
+		return []interface{}{v}, nil
+	}
+	id, e := convertID(v, reflect.TypeOf(ids[0]))
+	if e != nil {
+		return nil, e
+	}
+	return []interface{}{id}, nil
+}
+
+// convertID converts a generated ID to the type of the ID field
+func convertID(v interface{}, typ reflect.Type) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("generated id is nil")
+	}
+	if rv.Type() == typ {
+		return v, nil
+	}
+
+	if typ.Kind() == reflect.String {
+		var s string
+		switch id := v.(type) {
+		case primitive.ObjectID:
+			s = id.Hex()
+		case fmt.Stringer:
+			s = id.String()
+		default:
+			switch {
+			case rv.Kind() == reflect.String:
+				s = rv.String()
+			case isInt(rv):
+				s = strconv.FormatInt(rv.Int(), 10)
+			case isUint(rv):
+				s = strconv.FormatUint(rv.Uint(), 10)
+			default:
+				return nil, fmt.Errorf("generated id %v of type %T can't be used as %s", v, v, typ)
+			}
+		}
+		return reflect.ValueOf(s).Convert(typ).Interface(), nil
+	}
+
+	isNumber := func(t reflect.Type) bool {
+		return t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64
+	}
+	if isNumber(typ) != isNumber(rv.Type()) || !rv.Type().ConvertibleTo(typ) {
+		return nil, fmt.Errorf("generated id %v of type %T can't be used as %s", v, v, typ)
+	}
+	return rv.Convert(typ).Interface(), nil
+}
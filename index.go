@@ -0,0 +1,650 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/google/btree"
+)
+
+// Index declares a secondary index of a table. Ordered indexes keep the values
+// sorted and also serve range filters and sorted queries with a limit. Unique
+// indexes reject writes that give 2 records the same value, and may be declared
+// on several fields to make the combination of their values unique
+type Index struct {
+	Name    string
+	Fields  []string
+	Ordered bool
+	Unique  bool
+}
+
+func (ix Index) name() string {
+	if ix.Name != "" {
+		return ix.Name
+	}
+	return strings.Join(ix.Fields, "_")
+}
+
+// memIndex is a secondary index of a memTable. Entries of a record are added
+// for every version that is written, but are only removed once the version is
+// no longer visible to any snapshot. Hence an index may return keys of records
+// that don't match anymore, and records always need to be checked against the
+// filter after the lookup
+type memIndex interface {
+	declaration() Index
+	values(data interface{}) []interface{}
+	add(key string, value interface{})
+	remove(key string, value interface{})
+	lookup(values ...interface{}) []string
+}
+
+// hashIndex maps values of a field to keys of the records having that value. For
+// array fields every element is indexed. An index on several fields maps the
+// combined values of the fields, and records having an array in any of them are
+// not indexed
+type hashIndex struct {
+	decl    Index
+	lock    *sync.RWMutex
+	entries map[interface{}]map[string]struct{}
+}
+
+func newHashIndex(decl Index) *hashIndex {
+	ix := new(hashIndex)
+	ix.decl = decl
+	ix.lock = new(sync.RWMutex)
+	ix.entries = map[interface{}]map[string]struct{}{}
+	return ix
+}
+
+func (ix *hashIndex) declaration() Index {
+	return ix.decl
+}
+
+func (ix *hashIndex) values(data interface{}) []interface{} {
+	if len(ix.decl.Fields) == 1 {
+		return fieldIndexValues(data, ix.decl.Fields[0])
+	}
+
+	values := make([]interface{}, len(ix.decl.Fields))
+	for idx, field := range ix.decl.Fields {
+		v, _ := getFieldValue(data, field)
+		if _, isArray := arrayElements(v); isArray {
+			return nil
+		}
+		iv, ok := indexValue(v)
+		if !ok {
+			return nil
+		}
+		values[idx] = iv
+	}
+	return []interface{}{fmt.Sprintf("%#v", values)}
+}
+
+func (ix *hashIndex) add(key string, value interface{}) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	keys, ok := ix.entries[value]
+	if !ok {
+		keys = map[string]struct{}{}
+		ix.entries[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (ix *hashIndex) remove(key string, value interface{}) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	keys, ok := ix.entries[value]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(ix.entries, value)
+	}
+}
+
+// lookup returns keys of records that have, or had, any of the values
+func (ix *hashIndex) lookup(values ...interface{}) []string {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	if len(values) == 1 {
+		res := make([]string, 0, len(ix.entries[values[0]]))
+		for key := range ix.entries[values[0]] {
+			res = append(res, key)
+		}
+		return res
+	}
+
+	keys := map[string]struct{}{}
+	for _, value := range values {
+		for key := range ix.entries[value] {
+			keys[key] = struct{}{}
+		}
+	}
+	return keySlice(keys)
+}
+
+// orderedIndex keeps values of a field and keys of the records having them in a
+// b-tree ordered by value then key. For array fields every element is indexed, and
+// records with a value that can't be ordered are tracked in unordered
+type orderedIndex struct {
+	decl      Index
+	lock      *sync.RWMutex
+	tree      *btree.BTree
+	unordered map[string]int
+}
+
+type orderedItem struct {
+	value interface{}
+	key   string
+}
+
+func (it orderedItem) Less(than btree.Item) bool {
+	other := than.(orderedItem)
+	if c := compareIndexValue(it.value, other.value); c != 0 {
+		return c < 0
+	}
+	return it.key < other.key
+}
+
+// unorderedValue is the index value of a record version whose field value is an
+// array or can't be ordered
+type unorderedValue struct{}
+
+// indexBound is a value lower or greater than any other index value
+type indexBound int
+
+const (
+	minValue indexBound = -1
+	maxValue indexBound = 1
+)
+
+func compareIndexValue(a, b interface{}) int {
+	ba, aBound := a.(indexBound)
+	bb, bBound := b.(indexBound)
+	switch {
+	case aBound && bBound:
+		return compareInt(int64(ba), int64(bb))
+	case aBound:
+		return int(ba)
+	case bBound:
+		return -int(bb)
+	}
+	return compareValue(a, b)
+}
+
+func newOrderedIndex(decl Index) *orderedIndex {
+	ix := new(orderedIndex)
+	ix.decl = decl
+	ix.lock = new(sync.RWMutex)
+	ix.tree = btree.New(32)
+	ix.unordered = map[string]int{}
+	return ix
+}
+
+func (ix *orderedIndex) declaration() Index {
+	return ix.decl
+}
+
+// values returns the index values of the field, a missing field is indexed as
+// nil the same way it is sorted
+func (ix *orderedIndex) values(data interface{}) []interface{} {
+	v, _ := getFieldValue(data, ix.decl.Fields[0])
+	if _, isArray := arrayElements(v); isArray {
+		return append(fieldIndexValues(data, ix.decl.Fields[0]), unorderedValue{})
+	}
+	if iv, ok := indexValue(v); ok {
+		return []interface{}{iv}
+	}
+	return []interface{}{unorderedValue{}}
+}
+
+func (ix *orderedIndex) add(key string, value interface{}) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if _, ok := value.(unorderedValue); ok {
+		ix.unordered[key]++
+		return
+	}
+	ix.tree.ReplaceOrInsert(orderedItem{value, key})
+}
+
+func (ix *orderedIndex) remove(key string, value interface{}) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if _, ok := value.(unorderedValue); ok {
+		if ix.unordered[key]--; ix.unordered[key] <= 0 {
+			delete(ix.unordered, key)
+		}
+		return
+	}
+	ix.tree.Delete(orderedItem{value, key})
+}
+
+// ascend calls fn for the entries with value between from and to, both inclusive,
+// in ascending order until fn returns false
+func (ix *orderedIndex) ascend(from, to interface{}, fn func(value interface{}, key string) bool) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	ix.tree.AscendGreaterOrEqual(orderedItem{value: from}, func(i btree.Item) bool {
+		it := i.(orderedItem)
+		if compareIndexValue(it.value, to) > 0 {
+			return false
+		}
+		return fn(it.value, it.key)
+	})
+}
+
+// lookup returns keys of records that have, or had, any of the values
+func (ix *orderedIndex) lookup(values ...interface{}) []string {
+	keys := map[string]struct{}{}
+	for _, value := range values {
+		ix.ascend(value, value, func(_ interface{}, key string) bool {
+			keys[key] = struct{}{}
+			return true
+		})
+	}
+	return keySlice(keys)
+}
+
+// walk calls fn for all entries in ascending or descending order until fn
+// returns false. It returns false if some records can't be walked in order
+func (ix *orderedIndex) walk(desc bool, fn func(value interface{}, key string) bool) bool {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	if len(ix.unordered) > 0 {
+		return false
+	}
+	iter := func(i btree.Item) bool {
+		it := i.(orderedItem)
+		return fn(it.value, it.key)
+	}
+	if desc {
+		ix.tree.Descend(iter)
+	} else {
+		ix.tree.Ascend(iter)
+	}
+	return true
+}
+
+// fieldIndexValues returns the index values of a field of a record, which are
+// the elements for array fields
+func fieldIndexValues(data interface{}, field string) []interface{} {
+	v, e := getFieldValue(data, field)
+	if e != nil {
+		return nil
+	}
+	elems, isArray := arrayElements(v)
+	if !isArray {
+		elems = []interface{}{v}
+	}
+	res := make([]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		if iv, ok := indexValue(elem); ok {
+			res = append(res, iv)
+		}
+	}
+	return res
+}
+
+// indexValue normalizes a value so equal values as compared by filters are equal
+// map keys: numbers become float64, strings of named types become string and
+// times are converted to UTC without monotonic clock. Values that can't be used
+// as map key are not indexable
+func indexValue(v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.UTC().Round(0), true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch valueKind(rv) {
+	case kindNumber:
+		return toFloat(rv), true
+	case kindString:
+		return rv.String(), true
+	case kindBool:
+		return rv.Bool(), true
+	}
+	if !rv.Type().Comparable() || rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		return nil, false
+	}
+	return v, true
+}
+
+func keySlice(keys map[string]struct{}) []string {
+	res := make([]string, 0, len(keys))
+	for key := range keys {
+		res = append(res, key)
+	}
+	return res
+}
+
+// EnsureIndex creates an index on the table if an index with the same name does
+// not exist yet
+func (m *memTable) EnsureIndex(decl Index) error {
+	switch {
+	case len(decl.Fields) == 0:
+		return fmt.Errorf("index %s of %s should have at least 1 field", decl.name(), m.name)
+	case len(decl.Fields) > 1 && (decl.Ordered || !decl.Unique):
+		return fmt.Errorf("index %s of %s on several fields should be a unique hash index", decl.name(), m.name)
+	}
+
+	return clock.commit(func(ts uint64) error {
+		m.indexLock.Lock()
+		defer m.indexLock.Unlock()
+
+		for _, ix := range m.indexes {
+			if ix.declaration().name() == decl.name() {
+				return nil
+			}
+		}
+
+		var ix memIndex
+		if decl.Ordered {
+			ix = newOrderedIndex(decl)
+		} else {
+			ix = newHashIndex(decl)
+		}
+		owners := map[interface{}]string{}
+		var e error
+		m.records.Range(func(k, rec interface{}) bool {
+			key := k.(string)
+			for v := rec.(*memRecord).latest(); v != nil; v = v.prevVersion() {
+				if v.deleted {
+					continue
+				}
+				for _, value := range ix.values(v.data) {
+					ix.add(key, value)
+				}
+			}
+
+			if v := rec.(*memRecord).latest(); decl.Unique && v != nil && !v.deleted {
+				for _, value := range uniqueValues(ix, v.data) {
+					if owner, ok := owners[value]; ok {
+						e = &DuplicateKeyError{Table: m.name, Index: decl.name(), Key: key, Existing: owner, Value: value}
+						return false
+					}
+					owners[value] = key
+				}
+			}
+			return true
+		})
+		if e != nil {
+			return e
+		}
+		m.indexes = append(m.indexes, ix)
+		return nil
+	})
+}
+
+// checkUnique returns a DuplicateKeyError when data would have the same value of
+// a unique index as another record visible at timestamp ts. Records for which
+// skip returns true are not checked
+func (m *memTable) checkUnique(ts uint64, key string, data interface{}, skip func(key string) bool) error {
+	m.indexLock.RLock()
+	defer m.indexLock.RUnlock()
+
+	for _, ix := range m.indexes {
+		decl := ix.declaration()
+		if !decl.Unique {
+			continue
+		}
+		for _, value := range uniqueValues(ix, data) {
+			for _, other := range ix.lookup(value) {
+				if other == key || (skip != nil && skip(other)) {
+					continue
+				}
+				rec, ok := m.records.Load(other)
+				if !ok {
+					continue
+				}
+				// the index may still have the value of an older version of the record
+				v := rec.(*memRecord).at(ts)
+				if v == nil || v.deleted || !hasIndexValue(ix, v.data, value) {
+					continue
+				}
+				return &DuplicateKeyError{Table: m.name, Index: decl.name(), Key: key, Existing: other, Value: value}
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueValues returns the index values of data that need to be unique
+func uniqueValues(ix memIndex, data interface{}) []interface{} {
+	res := []interface{}{}
+	for _, value := range ix.values(data) {
+		if _, ok := value.(unorderedValue); !ok {
+			res = append(res, value)
+		}
+	}
+	return res
+}
+
+func hasIndexValue(ix memIndex, data interface{}, value interface{}) bool {
+	for _, v := range ix.values(data) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// indexVersion adds index entries of a new version of a record and removes the
+// entries of dropped versions that are not in any of the kept versions. It should
+// only be called within clock.commit
+func (m *memTable) indexVersion(key string, added *memVersion, dropped, kept []*memVersion) {
+	m.indexLock.RLock()
+	defer m.indexLock.RUnlock()
+
+	for _, ix := range m.indexes {
+		if added != nil && !added.deleted {
+			for _, value := range ix.values(added.data) {
+				ix.add(key, value)
+			}
+		}
+
+		if len(dropped) == 0 {
+			continue
+		}
+		keep := map[interface{}]bool{}
+		for _, v := range kept {
+			if v.deleted {
+				continue
+			}
+			for _, value := range ix.values(v.data) {
+				keep[value] = true
+			}
+		}
+		for _, v := range dropped {
+			if v.deleted {
+				continue
+			}
+			for _, value := range ix.values(v.data) {
+				if !keep[value] {
+					ix.remove(key, value)
+				}
+			}
+		}
+	}
+}
+
+// candidates returns keys of records that may match the filter by looking up
+// the indexes of the table. It returns false when the filter can't be served by
+// any index and the whole table need to be scanned
+func (m *memTable) candidates(mf *memFilter) ([]string, bool) {
+	if mf == nil {
+		return nil, false
+	}
+
+	f := mf.filter
+	switch f.Op {
+	case dbflex.OpEq, dbflex.OpIn:
+		values := []interface{}{f.Value}
+		if f.Op == dbflex.OpIn {
+			values = filterValues(f.Value)
+		}
+		for idx, value := range values {
+			iv, ok := indexValue(value)
+			if !ok {
+				return nil, false
+			}
+			values[idx] = iv
+		}
+		if ix := m.hashIndex(f.Field); ix != nil {
+			return ix.lookup(values...), true
+		}
+		if ix := m.orderedIndex(f.Field); ix != nil {
+			return ix.lookup(values...), true
+		}
+		return nil, false
+
+	case dbflex.OpGt, dbflex.OpGte, dbflex.OpLt, dbflex.OpLte, dbflex.OpRange, OpBetween:
+		ix := m.orderedIndex(f.Field)
+		if ix == nil {
+			return nil, false
+		}
+		bounds := []interface{}{f.Value}
+		if f.Op == dbflex.OpRange || f.Op == OpBetween {
+			if bounds = filterValues(f.Value); len(bounds) != 2 {
+				return nil, false
+			}
+		}
+		for idx, bound := range bounds {
+			iv, ok := indexValue(bound)
+			if !ok {
+				return nil, false
+			}
+			bounds[idx] = iv
+		}
+
+		// bounds are always inclusive, records are matched against the filter anyway
+		var from, to interface{} = minValue, maxValue
+		switch f.Op {
+		case dbflex.OpGt, dbflex.OpGte:
+			from = bounds[0]
+		case dbflex.OpLt, dbflex.OpLte:
+			to = bounds[0]
+		default:
+			from, to = bounds[0], bounds[1]
+		}
+		keys := map[string]struct{}{}
+		ix.ascend(from, to, func(_ interface{}, key string) bool {
+			keys[key] = struct{}{}
+			return true
+		})
+		return keySlice(keys), true
+
+	case dbflex.OpAnd:
+		var (
+			res   []string
+			found bool
+		)
+		for _, item := range mf.items {
+			if keys, ok := m.candidates(item); ok && (!found || len(keys) < len(res)) {
+				res, found = keys, true
+			}
+		}
+		return res, found
+
+	case dbflex.OpOr:
+		res := map[string]struct{}{}
+		for _, item := range mf.items {
+			keys, ok := m.candidates(item)
+			if !ok {
+				return nil, false
+			}
+			for _, key := range keys {
+				res[key] = struct{}{}
+			}
+		}
+		return keySlice(res), true
+	}
+
+	return nil, false
+}
+
+// FindSorted returns at least limit records matching the filter ordered by
+// fields, or all of them when there are fewer, by walking the ordered index of
+// the first field. Records having the same first field value as the last
+// returned record are returned as well so the caller can order them by the
+// remaining fields. It returns false when there is no usable ordered index
+func (m *memTable) FindSorted(where *memFilter, fields []sortField, limit int) ([]interface{}, bool) {
+	ts := clock.acquire()
+	defer clock.release(ts)
+	return m.findSortedAt(ts, where, fields, limit)
+}
+
+func (m *memTable) findSortedAt(ts uint64, where *memFilter, fields []sortField, limit int) ([]interface{}, bool) {
+	if len(fields) == 0 || limit <= 0 {
+		return nil, false
+	}
+	ix := m.orderedIndex(fields[0].name)
+	if ix == nil {
+		return nil, false
+	}
+
+	var (
+		res  []interface{}
+		last interface{}
+		seen = map[string]bool{}
+	)
+	ok := ix.walk(fields[0].desc, func(value interface{}, key string) bool {
+		if seen[key] {
+			return true
+		}
+		rec, found := m.records.Load(key)
+		if !found {
+			return true
+		}
+		v := rec.(*memRecord).at(ts)
+		if v == nil || v.deleted {
+			return true
+		}
+		// entries of other versions of the record are skipped
+		if values := ix.values(v.data); len(values) != 1 || values[0] != value {
+			return true
+		}
+		seen[key] = true
+		if where != nil && !where.Match(v.data) {
+			return true
+		}
+		if len(res) >= limit && compareValue(value, last) != 0 {
+			return false
+		}
+		res = append(res, v.data)
+		last = value
+		return true
+	})
+	return res, ok
+}
+
+func (m *memTable) orderedIndex(field string) *orderedIndex {
+	m.indexLock.RLock()
+	defer m.indexLock.RUnlock()
+	for _, ix := range m.indexes {
+		if oix, ok := ix.(*orderedIndex); ok && oix.decl.Fields[0] == field {
+			return oix
+		}
+	}
+	return nil
+}
+
+func (m *memTable) hashIndex(field string) *hashIndex {
+	m.indexLock.RLock()
+	defer m.indexLock.RUnlock()
+	for _, ix := range m.indexes {
+		if hix, ok := ix.(*hashIndex); ok && len(hix.decl.Fields) == 1 && hix.decl.Fields[0] == field {
+			return hix
+		}
+	}
+	return nil
+}
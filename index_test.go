@@ -0,0 +1,259 @@
+package flexmem_test
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestHashIndex(t *testing.T) {
+	t.Parallel()
+	convey.Convey("hash index", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		prepareFilterData(conn)
+		tableName := new(Obj).TableName()
+
+		e := conn.EnsureTable(tableName, []string{"Seed", "Name"}, new(Obj))
+		convey.So(e, convey.ShouldBeNil)
+		convey.So(conn.EnsureTable("plain_objs", nil, Obj{}), convey.ShouldNotBeNil)
+		convey.So(conn.EnsureTable("plain_objs", nil, toolkit.M{}), convey.ShouldNotBeNil)
+		convey.So(conn.HasTable("plain_objs"), convey.ShouldBeFalse)
+
+		cases := []struct {
+			filter *dbflex.Filter
+			count  int
+		}{
+			{dbflex.Eq("Seed", 3), testCount / 10},
+			{dbflex.Eq("Seed", 3.0), testCount / 10},
+			{dbflex.In("Seed", 1, 2), 2 * testCount / 10},
+			{dbflex.And(dbflex.Eq("Seed", 3), dbflex.Lt("Index", 50)), 5},
+			{dbflex.Or(dbflex.Eq("Seed", 3), dbflex.Eq("Name", "Name filter-001")), testCount/10 + 1},
+			{dbflex.Eq("Seed", 30), 0},
+		}
+		for _, c := range cases {
+			count, e := countWhere(conn, c.filter)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, c.count)
+		}
+
+		convey.Convey("maintained on write", func() {
+			obj := newObj("filter-new", randSeed)
+			obj.Seed = 3
+			_, e := conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+			convey.So(e, convey.ShouldBeNil)
+
+			_, e = conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", "filter-003")).Update("Seed"),
+				toolkit.M{}.Set("data", &Obj{Seed: 4}))
+			convey.So(e, convey.ShouldBeNil)
+			_, e = conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("Seed", 3)).Where(dbflex.Eq("Index", 13)).Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+
+			count, _ := countWhere(conn, dbflex.Eq("Seed", 3))
+			convey.So(count, convey.ShouldEqual, testCount/10-1)
+			count, _ = countWhere(conn, dbflex.Eq("Seed", 4))
+			convey.So(count, convey.ShouldEqual, testCount/10+1)
+
+			convey.Convey("in transaction", func() {
+				convey.So(conn.BeginTx(), convey.ShouldBeNil)
+				for i := 0; i < 3; i++ {
+					obj := newObj(fmt.Sprintf("filter-tx-%d", i), randSeed)
+					obj.Seed = 3
+					conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+				}
+				count, _ := countWhere(conn, dbflex.Eq("Seed", 3))
+				convey.So(count, convey.ShouldEqual, testCount/10+2)
+				convey.So(conn.Commit(), convey.ShouldBeNil)
+				count, _ = countWhere(conn, dbflex.In("Seed", 3))
+				convey.So(count, convey.ShouldEqual, testCount/10+2)
+			})
+		})
+	})
+}
+
+func TestOrderedIndex(t *testing.T) {
+	t.Parallel()
+	convey.Convey("ordered index", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		prepareFilterData(conn)
+		tableName := new(Obj).TableName()
+
+		convey.So(conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Index"}, Ordered: true}), convey.ShouldBeNil)
+		convey.So(conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Seed"}, Ordered: true}), convey.ShouldBeNil)
+
+		cases := []struct {
+			filter *dbflex.Filter
+			count  int
+		}{
+			{dbflex.Gt("Index", 90), 10},
+			{dbflex.Gte("Index", 90), 11},
+			{dbflex.Lt("Index", 11), 10},
+			{dbflex.Lte("Index", 11.0), 11},
+			{dbflex.Range("Index", 21, 30), 10},
+			{flexmem.Between("Index", 21, 30), 8},
+			{dbflex.And(dbflex.Gt("Index", 50), dbflex.Eq("Seed", 1)), 5},
+			{dbflex.Or(dbflex.Lt("Index", 3), dbflex.Gt("Index", 98)), 4},
+			{dbflex.In("Seed", 1, 2), 2 * testCount / 10},
+			{dbflex.Gt("Index", "a"), 0},
+		}
+		for _, c := range cases {
+			count, e := countWhere(conn, c.filter)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(count, convey.ShouldEqual, c.count)
+		}
+
+		convey.Convey("sort and take", func() {
+			objs := []Obj{}
+			cmd := dbflex.From(tableName).Where(dbflex.Lt("Index", 90)).OrderBy("-Index").Skip(5).Take(10).Select()
+			e := conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(objs), convey.ShouldEqual, 10)
+			convey.So(objs[0].Index, convey.ShouldEqual, 84)
+			convey.So(objs[9].Index, convey.ShouldEqual, 75)
+
+			cmd = dbflex.From(tableName).OrderBy("Seed", "-Index").Take(3).Select()
+			e = conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(objs), convey.ShouldEqual, 3)
+			convey.So(objs[0].Index, convey.ShouldEqual, testCount)
+			convey.So(objs[1].Index, convey.ShouldEqual, testCount-10)
+			convey.So(objs[2].Index, convey.ShouldEqual, testCount-20)
+
+			convey.Convey("after update and in transaction", func() {
+				_, e := conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", "filter-050")).Update("Index"),
+					toolkit.M{}.Set("data", &Obj{Index: 500}))
+				convey.So(e, convey.ShouldBeNil)
+
+				convey.So(conn.BeginTx(), convey.ShouldBeNil)
+				defer conn.RollBack()
+				obj := newObj("filter-tx", randSeed)
+				obj.Index = 1000
+				conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+
+				cmd := dbflex.From(tableName).OrderBy("-Index").Take(2).Select()
+				e = conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close()
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(len(objs), convey.ShouldEqual, 2)
+				convey.So(objs[0].Index, convey.ShouldEqual, 1000)
+				convey.So(objs[1].Index, convey.ShouldEqual, 500)
+
+				count, _ := countWhere(conn, dbflex.Range("Index", 45, 55))
+				convey.So(count, convey.ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestUniqueIndex(t *testing.T) {
+	t.Parallel()
+	convey.Convey("unique index", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		prepareFilterData(conn)
+		tableName := new(Obj).TableName()
+
+		e := conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Seed"}, Unique: true})
+		convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+		convey.So(conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Name"}, Unique: true}), convey.ShouldBeNil)
+		convey.So(conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Seed", "Index"}, Unique: true}), convey.ShouldBeNil)
+
+		insert := func(conn dbflex.IConnection, id, name string, seed, index int) error {
+			obj := &Obj{ID: id, Name: name, Seed: seed, Index: index}
+			_, e := conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+			return e
+		}
+
+		convey.Convey("insert", func() {
+			e := insert(conn, "filter-001", "Name new", 0, 0)
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+			e = insert(conn, "unique-1", "Name filter-001", 0, 0)
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+			de := e.(*flexmem.DuplicateKeyError)
+			convey.So(de.Index, convey.ShouldEqual, "Name")
+			convey.So(de.Existing, convey.ShouldEqual, "filter-001")
+			e = insert(conn, "unique-1", "Name unique-1", 1, 1)
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+			convey.So(insert(conn, "unique-1", "Name unique-1", 2, 1), convey.ShouldBeNil)
+
+			_, e = conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", "filter-001")).Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(insert(conn, "unique-2", "Name filter-001", 1, 1), convey.ShouldBeNil)
+		})
+
+		convey.Convey("update", func() {
+			update := func(id, name string) error {
+				_, e := conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", id)).Update("Name"),
+					toolkit.M{}.Set("data", &Obj{Name: name}))
+				return e
+			}
+			convey.So(flexmem.IsDuplicateKey(update("filter-002", "Name filter-001")), convey.ShouldBeTrue)
+			convey.So(update("filter-002", "Name filter-002"), convey.ShouldBeNil)
+			convey.So(update("filter-002", "Name changed"), convey.ShouldBeNil)
+			convey.So(update("filter-001", "Name filter-002"), convey.ShouldBeNil)
+		})
+
+		convey.Convey("in transaction", func() {
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			convey.So(insert(conn, "unique-1", "Name unique", 0, 0), convey.ShouldBeNil)
+			e := insert(conn, "unique-2", "Name unique", 0, 0)
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+
+			other := flexmemtest.Connect(t, conn)
+			convey.So(insert(other, "unique-3", "Name unique", 0, 0), convey.ShouldBeNil)
+
+			e = conn.Commit()
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+			count, _ := countWhere(conn, dbflex.Eq("Name", "Name unique"))
+			convey.So(count, convey.ShouldEqual, 1)
+		})
+	})
+}
+
+const benchCount = 1000000
+
+func prepareBenchData(b *testing.B) *flexmem.Connection {
+	conn := flexmemtest.New(b, new(Obj))
+	tableName := new(Obj).TableName()
+	for i := 1; i <= benchCount; i++ {
+		obj := &Obj{ID: fmt.Sprintf("bench-%07d", i), Index: i, Seed: i % 100}
+		if _, e := conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj)); e != nil {
+			b.Fatal(e)
+		}
+	}
+	return conn
+}
+
+func BenchmarkOrderedIndex(b *testing.B) {
+	conn := prepareBenchData(b)
+	tableName := new(Obj).TableName()
+
+	run := func(b *testing.B, cmd dbflex.ICommand, expected int) {
+		for i := 0; i < b.N; i++ {
+			objs := []Obj{}
+			if e := conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close(); e != nil {
+				b.Fatal(e)
+			}
+			if len(objs) != expected {
+				b.Fatalf("expected %d records, got %d", expected, len(objs))
+			}
+		}
+	}
+	queries := func(b *testing.B) {
+		b.Run("Range", func(b *testing.B) {
+			run(b, dbflex.From(tableName).Where(dbflex.Range("Index", 500001, 500100)).Select(), 100)
+		})
+		b.Run("SortTake", func(b *testing.B) {
+			run(b, dbflex.From(tableName).OrderBy("-Index").Take(10).Select(), 10)
+		})
+	}
+
+	b.Run("Scan", queries)
+	e := conn.EnsureIndex(tableName, flexmem.Index{Fields: []string{"Index"}, Ordered: true})
+	if e != nil {
+		b.Fatal(e)
+	}
+	b.Run("Index", queries)
+}
@@ -0,0 +1,102 @@
+package flexmem
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RecordKey returns the key of a record from the values of its ID fields, as
+// returned by GetID of orm.DataModel. A single string ID is the key itself,
+// other values are formatted and the values of composite IDs are joined by "|"
+func RecordKey(ids ...interface{}) (string, error) {
+	if len(ids) == 0 {
+		return "", errors.New("record has no id")
+	}
+	if len(ids) == 1 {
+		if s, ok := ids[0].(string); ok {
+			return s, nil
+		}
+	}
+
+	parts := make([]string, len(ids))
+	for idx, id := range ids {
+		part, e := keyPart(id)
+		if e != nil {
+			return "", e
+		}
+		if len(ids) > 1 {
+			part = strings.NewReplacer(`\`, `\\`, "|", `\|`).Replace(part)
+		}
+		parts[idx] = part
+	}
+	return strings.Join(parts, "|"), nil
+}
+
+// typedKeyPrefix starts the document keys of non-string IDs, string IDs starting
+// with it are escaped by doubling it
+const typedKeyPrefix = "#"
+
+// DocumentKey returns the key of a document of a schemaless table from its ID.
+// Unlike RecordKey, the key of a non-string ID holds its type, so documents with
+// the IDs 1 and "1" are different records
+func DocumentKey(ids ...interface{}) (string, error) {
+	if len(ids) != 1 {
+		return RecordKey(ids...)
+	}
+	if s, ok := ids[0].(string); ok {
+		if strings.HasPrefix(s, typedKeyPrefix) {
+			return typedKeyPrefix + s, nil
+		}
+		return s, nil
+	}
+	part, e := keyPart(ids[0])
+	if e != nil {
+		return "", e
+	}
+	return fmt.Sprintf("%s%T:%s", typedKeyPrefix, ids[0], part), nil
+}
+
+// recordKey returns the key of a record of the table, a DocumentKey when the
+// table is schemaless and a RecordKey otherwise
+func (m *memTable) recordKey(ids ...interface{}) (string, error) {
+	lock.RLock()
+	schemaless := m.model == nil
+	lock.RUnlock()
+	if schemaless {
+		return DocumentKey(ids...)
+	}
+	return RecordKey(ids...)
+}
+
+func keyPart(id interface{}) (string, error) {
+	rv := reflect.ValueOf(id)
+	if !rv.IsValid() || !rv.Type().Comparable() || rv.Kind() == reflect.Ptr {
+		return "", fmt.Errorf("invalid id %v of type %T", id, id)
+	}
+
+	switch v := id.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	}
+	if rv.Kind() == reflect.String {
+		return rv.String(), nil
+	}
+	return fmt.Sprint(id), nil
+}
+
+// isZeroID returns true when every value of the ID is the zero value of its type
+func isZeroID(ids []interface{}) bool {
+	for _, id := range ids {
+		if rv := reflect.ValueOf(id); rv.IsValid() && !rv.IsZero() {
+			return false
+		}
+	}
+	return true
+}
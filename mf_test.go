@@ -2,6 +2,7 @@ package flexmem_test
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,7 +10,9 @@ import (
 	"git.kanosolution.net/kano/dbflex/orm"
 	"github.com/eaciit/toolkit"
 	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
 	"github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
@@ -18,6 +21,7 @@ const (
 	randSeed  = 5000
 )
 
+// TestCRUD uses the default database, the other tests get their own from flexmemtest
 func TestCRUD(t *testing.T) {
 	convey.Convey("connection", t, func() {
 		conn, e := dbflex.NewConnectionFromURI(flexmem.DriverName+"://localhost", nil)
@@ -116,10 +120,9 @@ func TestCRUD(t *testing.T) {
 }
 
 func TestGroup(t *testing.T) {
+	t.Parallel()
 	convey.Convey("prepare", t, func() {
-		conn, _ := dbflex.NewConnectionFromURI(flexmem.DriverName+"://localhost", nil)
-		conn.Connect()
-		flexmem.RegisterObject(new(Obj))
+		conn := flexmemtest.New(t, new(Obj))
 
 		convey.Convey("insert object", func() {
 			for i := 1; i <= testCount; i++ {
@@ -176,3 +179,545 @@ func newObj(id string, seed int) *Obj {
 	obj.Seed = toolkit.RandInt(seed)
 	return obj
 }
+
+func TestConcurrentAccess(t *testing.T) {
+	t.Parallel()
+	convey.Convey("concurrent access", t, func() {
+		db := flexmemtest.New(t, new(Obj))
+		tableName := new(Obj).TableName()
+
+		workers := 8
+		wg := new(sync.WaitGroup)
+		wg.Add(workers * 2)
+		for w := 0; w < workers; w++ {
+			writer, reader := flexmemtest.Connect(t, db), flexmemtest.Connect(t, db)
+			go func(w int, conn dbflex.IConnection) {
+				defer wg.Done()
+				for i := 0; i < testCount; i++ {
+					obj := newObj(fmt.Sprintf("worker-%d-%d", w, i), randSeed)
+					obj.Index = i
+					conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+					if i%10 == 0 {
+						obj.Seed = 0
+						conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", obj.ID)).Update("Seed"), toolkit.M{}.Set("data", obj))
+					}
+				}
+				conn.Execute(dbflex.From(tableName).Where(dbflex.Gte("Index", testCount/2)).Delete(), nil)
+			}(w, writer)
+
+			go func(conn dbflex.IConnection) {
+				defer wg.Done()
+				for i := 0; i < testCount; i++ {
+					objs := []Obj{}
+					conn.Cursor(dbflex.From(tableName).Where(dbflex.Gt("Seed", 0)).Select(), nil).Fetchs(&objs, 0).Close()
+				}
+			}(reader)
+		}
+		wg.Wait()
+
+		convey.So(db.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, workers*testCount/2)
+	})
+}
+
+func TestStoredCopy(t *testing.T) {
+	t.Parallel()
+	convey.Convey("stored records are copies", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		get := func(id string) *Obj {
+			res := new(Obj)
+			conn.Cursor(dbflex.From("objs").Where(dbflex.Eq("ID", id)).Select(), nil).Fetch(res).Close()
+			return res
+		}
+
+		obj := newObj("obj-1", randSeed)
+		obj.Seed = 1
+		_, e := conn.Execute(dbflex.From("objs").Insert(), toolkit.M{}.Set("data", obj))
+		convey.So(e, convey.ShouldBeNil)
+
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for i := 0; i < testCount; i++ {
+				objs := []*Obj{}
+				conn.Cursor(dbflex.From("objs").Where(dbflex.Gt("Seed", 0)).Select(), nil).Fetchs(&objs, 0).Close()
+			}
+		}()
+		for i := 0; i < testCount; i++ {
+			obj.Seed = 0
+		}
+		<-done
+		convey.So(get("obj-1").Seed, convey.ShouldEqual, 1)
+
+		saved := newObj("obj-2", randSeed)
+		saved.Seed = 2
+		_, e = conn.Execute(dbflex.From("objs").Save(), toolkit.M{}.Set("data", saved))
+		convey.So(e, convey.ShouldBeNil)
+		saved.Seed = 0
+		convey.So(get("obj-2").Seed, convey.ShouldEqual, 2)
+
+		fetched := get("obj-1")
+		fetched.Seed = 10
+		res, e := conn.Execute(dbflex.From("objs").Where(dbflex.Eq("ID", "obj-1")).Update(), toolkit.M{}.
+			Set(flexmem.ParmOps, flexmem.Inc("Seed", 1)).Set(flexmem.ParmReturnRecords, true))
+		convey.So(e, convey.ShouldBeNil)
+		res.(*flexmem.UpdateResult).Records[0].(*Obj).Seed = 10
+		convey.So(get("obj-1").Seed, convey.ShouldEqual, 2)
+
+		convey.So(conn.BeginTx(), convey.ShouldBeNil)
+		inTx := newObj("obj-3", randSeed)
+		inTx.Seed = 3
+		_, e = conn.Execute(dbflex.From("objs").Insert(), toolkit.M{}.Set("data", inTx))
+		convey.So(e, convey.ShouldBeNil)
+		inTx.Seed = 0
+		convey.So(conn.Commit(), convey.ShouldBeNil)
+		convey.So(get("obj-3").Seed, convey.ShouldEqual, 3)
+	})
+}
+
+func TestSortSkipTake(t *testing.T) {
+	t.Parallel()
+	convey.Convey("prepare", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		tableName := new(Obj).TableName()
+
+		for i := 1; i <= testCount; i++ {
+			insertObj := newObj(fmt.Sprintf("user-manual-%d", i), randSeed)
+			insertObj.Index = i
+			insertObj.Seed = i % 4
+			conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", insertObj))
+		}
+
+		convey.Convey("sort, skip and take", func() {
+			objs := []Obj{}
+			cmd := dbflex.From(tableName).OrderBy("-Index").Skip(5).Take(10).Select()
+			e := conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(objs), convey.ShouldEqual, 10)
+			convey.So(objs[0].Index, convey.ShouldEqual, testCount-5)
+			convey.So(objs[9].Index, convey.ShouldEqual, testCount-14)
+
+			cmd = dbflex.From(tableName).OrderBy("Seed", "-Index").Take(3).Select()
+			e = conn.Cursor(cmd, nil).Fetchs(&objs, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(objs), convey.ShouldEqual, 3)
+			convey.So(objs[0].Index, convey.ShouldEqual, testCount)
+			convey.So(objs[1].Index, convey.ShouldEqual, testCount-4)
+		})
+
+		convey.Convey("grouped", func() {
+			results := []toolkit.M{}
+			cmd := dbflex.From(tableName).GroupBy("Seed").
+				Aggr(dbflex.NewAggrItem("Count", dbflex.AggrCount, "Seed")).
+				OrderBy("-Key").Skip(1).Take(2)
+			e := conn.Cursor(cmd, nil).Fetchs(&results, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(results), convey.ShouldEqual, 2)
+			convey.So(results[0].GetInt("Key"), convey.ShouldEqual, 2)
+			convey.So(results[1].GetInt("Key"), convey.ShouldEqual, 1)
+		})
+	})
+}
+
+func TestSelectFields(t *testing.T) {
+	t.Parallel()
+	convey.Convey("prepare", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		tableName := new(Obj).TableName()
+
+		obj := newObj("select-1", randSeed)
+		obj.Index = 7
+		conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+
+		convey.Convey("into struct", func() {
+			res := new(Obj)
+			e := conn.Cursor(dbflex.From(tableName).Select("ID", "Name"), nil).Fetch(res).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(res.ID, convey.ShouldEqual, obj.ID)
+			convey.So(res.Name, convey.ShouldEqual, obj.Name)
+			convey.So(res.Index, convey.ShouldEqual, 0)
+			convey.So(res.Date.IsZero(), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("into map", func() {
+			res := []toolkit.M{}
+			e := conn.Cursor(dbflex.From(tableName).Select("ID", "Index"), nil).Fetchs(&res, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(res), convey.ShouldEqual, 1)
+			convey.So(len(res[0]), convey.ShouldEqual, 2)
+			convey.So(res[0].GetInt("Index"), convey.ShouldEqual, 7)
+		})
+	})
+}
+
+func TestDottedPath(t *testing.T) {
+	t.Parallel()
+	convey.Convey("prepare", t, func() {
+		conn := flexmemtest.New(t, new(Order))
+		tableName := new(Order).TableName()
+
+		cities := []string{"Jakarta", "Bandung", "Surabaya"}
+		for i := 1; i <= 30; i++ {
+			order := &Order{
+				ID:      fmt.Sprintf("order-%d", i),
+				Address: Address{City: cities[i%3]},
+				Items:   []OrderItem{{Qty: i}, {Qty: i * 2}},
+				Extra:   toolkit.M{"Channel": toolkit.M{"Name": fmt.Sprintf("channel-%d", i%2)}},
+			}
+			_, e := conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", order))
+			convey.So(e, convey.ShouldBeNil)
+		}
+
+		convey.Convey("filter", func() {
+			cr := conn.Cursor(dbflex.From(tableName).Where(dbflex.And(
+				dbflex.Eq("Address.City", "Bandung"),
+				dbflex.Gt("Items.1.Qty", 20),
+				dbflex.Eq("Extra.Channel.Name", "channel-1"))).Select(), nil)
+			convey.So(cr.Error(), convey.ShouldBeNil)
+			// i%3 == 1, i > 10 and i is odd: 13, 19, 25
+			convey.So(cr.Count(), convey.ShouldEqual, 3)
+		})
+
+		convey.Convey("sort and group", func() {
+			orders := []Order{}
+			e := conn.Cursor(dbflex.From(tableName).OrderBy("-Items.0.Qty").Take(1).Select(), nil).Fetchs(&orders, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(orders[0].ID, convey.ShouldEqual, "order-30")
+
+			results := []toolkit.M{}
+			cmd := dbflex.From(tableName).GroupBy("Address.City").
+				Aggr(dbflex.NewAggrItem("Qty", dbflex.AggrSum, "Items.0.Qty")).OrderBy("Key")
+			e = conn.Cursor(cmd, nil).Fetchs(&results, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(results), convey.ShouldEqual, 3)
+			convey.So(results[0].GetString("Key"), convey.ShouldEqual, "Bandung")
+		})
+
+		convey.Convey("projection", func() {
+			res := []toolkit.M{}
+			e := conn.Cursor(dbflex.From(tableName).Where(dbflex.Eq("ID", "order-2")).Select("Address.City", "Items.1.Qty"), nil).
+				Fetchs(&res, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(res[0].Get("Address").(toolkit.M).GetString("City"), convey.ShouldEqual, "Surabaya")
+
+			order := new(Order)
+			e = conn.Cursor(dbflex.From(tableName).Where(dbflex.Eq("ID", "order-2")).Select("ID", "Items.1.Qty"), nil).
+				Fetch(order).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(order.Address.City, convey.ShouldEqual, "")
+			convey.So(len(order.Items), convey.ShouldEqual, 2)
+			convey.So(order.Items[1].Qty, convey.ShouldEqual, 4)
+		})
+	})
+}
+
+type Address struct {
+	City string
+}
+
+type OrderItem struct {
+	Qty int
+}
+
+type Order struct {
+	orm.DataModelBase
+	ID      string
+	Address Address
+	Items   []OrderItem
+	Tags    []string
+	Extra   toolkit.M
+}
+
+func (o *Order) TableName() string {
+	return "orders"
+}
+
+func (o *Order) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+type Counter struct {
+	orm.DataModelBase
+	ID    int
+	Count int
+}
+
+func (o *Counter) TableName() string {
+	return "counters"
+}
+
+func (o *Counter) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Counter) SetID(keys ...interface{}) {
+	o.ID = keys[0].(int)
+}
+
+type Period struct {
+	orm.DataModelBase
+	Code  string
+	Year  int
+	Total float64
+}
+
+func (o *Period) TableName() string {
+	return "periods"
+}
+
+func (o *Period) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"Code", "Year"}, []interface{}{o.Code, o.Year}
+}
+
+type Doc struct {
+	orm.DataModelBase
+	ID    primitive.ObjectID
+	Title string
+}
+
+func (o *Doc) TableName() string {
+	return "docs"
+}
+
+func (o *Doc) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Doc) SetID(keys ...interface{}) {
+	o.ID = keys[0].(primitive.ObjectID)
+}
+
+func TestRecordKey(t *testing.T) {
+	t.Parallel()
+	convey.Convey("record keys", t, func() {
+		conn := flexmemtest.New(t, new(Counter), new(Period), new(Doc))
+
+		convey.Convey("int id", func() {
+			for i := 1; i <= 3; i++ {
+				_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: i}))
+				convey.So(e, convey.ShouldBeNil)
+			}
+			_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: 2}))
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+			_, e = conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{}))
+			convey.So(e, convey.ShouldNotBeNil)
+
+			_, e = conn.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 2)).Update("Count"),
+				toolkit.M{}.Set("data", &Counter{Count: 5}))
+			convey.So(e, convey.ShouldBeNil)
+			version, _ := conn.RecordVersion("counters", "2")
+			convey.So(version, convey.ShouldEqual, 2)
+
+			counters := []Counter{}
+			e = conn.Cursor(dbflex.From("counters").OrderBy("ID").Select(), nil).Fetchs(&counters, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(counters), convey.ShouldEqual, 3)
+			convey.So(counters[1].Count, convey.ShouldEqual, 5)
+		})
+
+		convey.Convey("composite id", func() {
+			for _, p := range []*Period{{Code: "A", Year: 2020}, {Code: "A", Year: 2021}, {Code: "B", Year: 2020}} {
+				_, e := conn.Execute(dbflex.From("periods").Insert(), toolkit.M{}.Set("data", p))
+				convey.So(e, convey.ShouldBeNil)
+			}
+			_, e := conn.Execute(dbflex.From("periods").Insert(), toolkit.M{}.Set("data", &Period{Code: "A", Year: 2021}))
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+
+			key, _ := flexmem.RecordKey("A", 2021)
+			convey.So(key, convey.ShouldEqual, "A|2021")
+			version, _ := conn.RecordVersion("periods", key)
+			convey.So(version, convey.ShouldEqual, 1)
+
+			n, e := conn.Execute(dbflex.From("periods").Where(dbflex.Eq("Code", "A")).Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(n, convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("generated object id", func() {
+			doc := &Doc{Title: "first"}
+			_, e := conn.Execute(dbflex.From("docs").Insert(), toolkit.M{}.Set("data", doc))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(doc.ID.IsZero(), convey.ShouldBeFalse)
+
+			docs := []Doc{}
+			e = conn.Cursor(dbflex.From("docs").Where(dbflex.Eq("ID", doc.ID)).Select(), nil).Fetchs(&docs, 0).Close()
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(docs), convey.ShouldEqual, 1)
+		})
+	})
+}
+
+type Note struct {
+	orm.DataModelBase
+	ID   string
+	Text string
+}
+
+func (o *Note) TableName() string {
+	return "notes"
+}
+
+func (o *Note) GetID(_ dbflex.IConnection) ([]string, []interface{}) {
+	return []string{"ID"}, []interface{}{o.ID}
+}
+
+func (o *Note) SetID(keys ...interface{}) {
+	o.ID = keys[0].(string)
+}
+
+func TestIDGenerator(t *testing.T) {
+	t.Parallel()
+	convey.Convey("id generator", t, func() {
+		conn := flexmemtest.New(t, new(Counter), new(Note))
+
+		insertNote := func() *Note {
+			note := new(Note)
+			_, e := conn.Execute(dbflex.From("notes").Insert(), toolkit.M{}.Set("data", note))
+			convey.So(e, convey.ShouldBeNil)
+			return note
+		}
+
+		convey.Convey("sequential per table", func() {
+			convey.So(conn.SetTableIDGenerator("counters", flexmem.SequentialGenerator(1)), convey.ShouldBeNil)
+			for i := 1; i <= 3; i++ {
+				counter := new(Counter)
+				_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", counter))
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(counter.ID, convey.ShouldEqual, i)
+			}
+			convey.So(len(insertNote().ID), convey.ShouldEqual, 24)
+
+			conn.SetIDGenerator(flexmem.SequentialGenerator(100))
+			convey.So(insertNote().ID, convey.ShouldEqual, "100")
+			convey.So(insertNote().ID, convey.ShouldEqual, "101")
+		})
+
+		convey.Convey("uuid", func() {
+			conn.SetIDGenerator(flexmem.UUIDv4Generator())
+			convey.So(len(insertNote().ID), convey.ShouldEqual, 36)
+			conn.SetIDGenerator(flexmem.UUIDv7Generator())
+			first, second := insertNote().ID, insertNote().ID
+			convey.So(len(first), convey.ShouldEqual, 36)
+			convey.So(first, convey.ShouldBeLessThan, second)
+		})
+
+		convey.Convey("callback", func() {
+			conn.SetIDGenerator(func(tableName string, _ interface{}) (interface{}, error) {
+				return tableName + "-fixed", nil
+			})
+			convey.So(insertNote().ID, convey.ShouldEqual, "notes-fixed")
+
+			_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", new(Counter)))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSequence(t *testing.T) {
+	t.Parallel()
+	convey.Convey("sequence", t, func() {
+		conn := flexmemtest.New(t, new(Counter))
+
+		e := conn.EnsureSequence(flexmem.Sequence{Name: "counter_id", Table: "counters"})
+		convey.So(e, convey.ShouldBeNil)
+		e = conn.EnsureSequence(flexmem.Sequence{Name: "counter_count", Table: "counters", Field: "Count", Start: 100, Step: 10})
+		convey.So(e, convey.ShouldBeNil)
+
+		insert := func(conn dbflex.IConnection, counter *Counter) error {
+			_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", counter))
+			return e
+		}
+
+		for i := 1; i <= 2; i++ {
+			counter := new(Counter)
+			convey.So(insert(conn, counter), convey.ShouldBeNil)
+			convey.So(counter.ID, convey.ShouldEqual, i)
+			convey.So(counter.Count, convey.ShouldEqual, 90+i*10)
+		}
+		counter := &Counter{ID: 50, Count: 5}
+		convey.So(insert(conn, counter), convey.ShouldBeNil)
+		convey.So(counter.Count, convey.ShouldEqual, 5)
+
+		convey.Convey("rollback", func() {
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			counter := new(Counter)
+			convey.So(insert(conn, counter), convey.ShouldBeNil)
+			convey.So(counter.ID, convey.ShouldEqual, 3)
+			convey.So(conn.RollBack(), convey.ShouldBeNil)
+
+			counter = new(Counter)
+			convey.So(insert(conn, counter), convey.ShouldBeNil)
+			convey.So(counter.ID, convey.ShouldEqual, 3)
+			convey.So(counter.Count, convey.ShouldEqual, 120)
+		})
+
+		convey.Convey("concurrent transaction", func() {
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			convey.So(insert(conn, new(Counter)), convey.ShouldBeNil)
+
+			other := flexmemtest.Connect(t, conn)
+			counter := new(Counter)
+			convey.So(insert(other, counter), convey.ShouldBeNil)
+			convey.So(counter.ID, convey.ShouldEqual, 3)
+
+			e := conn.Commit()
+			convey.So(flexmem.IsVersionConflict(e), convey.ShouldBeTrue)
+		})
+
+		convey.Convey("free sequence", func() {
+			name := "free"
+			for i := 1; i <= 3; i++ {
+				value, e := conn.NextSequence(name)
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(value, convey.ShouldEqual, i)
+			}
+		})
+	})
+}
+
+func TestSave(t *testing.T) {
+	t.Parallel()
+	convey.Convey("save", t, func() {
+		conn := flexmemtest.New(t, new(Note))
+
+		save := func(note *Note, parm toolkit.M) error {
+			if parm == nil {
+				parm = toolkit.M{}
+			}
+			_, e := conn.Execute(dbflex.From("notes").Save(), parm.Set("data", note))
+			return e
+		}
+		get := func(id string) []Note {
+			notes := []Note{}
+			conn.Cursor(dbflex.From("notes").Where(dbflex.Eq("ID", id)).Select(), nil).Fetchs(&notes, 0).Close()
+			return notes
+		}
+
+		convey.So(save(&Note{ID: "note-1", Text: "first"}, nil), convey.ShouldBeNil)
+		convey.So(save(&Note{ID: "note-1", Text: "changed"}, nil), convey.ShouldBeNil)
+		notes := get("note-1")
+		convey.So(len(notes), convey.ShouldEqual, 1)
+		convey.So(notes[0].Text, convey.ShouldEqual, "changed")
+
+		note := &Note{Text: "generated"}
+		convey.So(save(note, nil), convey.ShouldBeNil)
+		convey.So(note.ID, convey.ShouldNotBeEmpty)
+		convey.So(len(get(note.ID)), convey.ShouldEqual, 1)
+
+		convey.Convey("with version", func() {
+			e := save(&Note{ID: "note-1", Text: "stale"}, toolkit.M{}.Set(flexmem.ParmVersion, 1))
+			convey.So(flexmem.IsVersionConflict(e), convey.ShouldBeTrue)
+			convey.So(save(&Note{ID: "note-1", Text: "versioned"}, toolkit.M{}.Set(flexmem.ParmVersion, 2)), convey.ShouldBeNil)
+			convey.So(save(&Note{ID: "note-2", Text: "new"}, toolkit.M{}.Set(flexmem.ParmVersion, 0)), convey.ShouldBeNil)
+			convey.So(get("note-1")[0].Text, convey.ShouldEqual, "versioned")
+		})
+
+		convey.Convey("in transaction", func() {
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			convey.So(save(&Note{ID: "note-1", Text: "in tx"}, nil), convey.ShouldBeNil)
+			convey.So(save(&Note{ID: "note-3", Text: "in tx"}, nil), convey.ShouldBeNil)
+			convey.So(conn.Commit(), convey.ShouldBeNil)
+			convey.So(get("note-1")[0].Text, convey.ShouldEqual, "in tx")
+			convey.So(len(get("note-3")), convey.ShouldEqual, 1)
+		})
+	})
+}
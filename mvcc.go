@@ -0,0 +1,147 @@
+package flexmem
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// memVersion is one committed version of a record. Versions of the same key
+// are chained from the newest to the oldest one, and are never modified once
+// they are published, except for cutting the chain of versions that are no
+// longer visible to any reader
+type memVersion struct {
+	ts      uint64
+	rev     int64
+	data    interface{}
+	deleted bool
+	prev    atomic.Value
+}
+
+func (v *memVersion) prevVersion() *memVersion {
+	p, _ := v.prev.Load().(*memVersion)
+	return p
+}
+
+type memRecord struct {
+	head atomic.Value
+}
+
+func (r *memRecord) latest() *memVersion {
+	v, _ := r.head.Load().(*memVersion)
+	return v
+}
+
+// at returns the newest version that is visible for a reader at timestamp ts
+func (r *memRecord) at(ts uint64) *memVersion {
+	for v := r.latest(); v != nil; v = v.prevVersion() {
+		if v.ts <= ts {
+			return v
+		}
+	}
+	return nil
+}
+
+// push publishes a new version on top of the chain and drops versions that can't
+// be seen anymore by any snapshot at or after oldest. Revision of the new version
+// is the one of the previous version plus one. It returns the dropped versions
+// and the versions that are kept in the chain
+func (r *memRecord) push(v *memVersion, oldest uint64) (dropped, kept []*memVersion) {
+	v.rev = 1
+	if head := r.latest(); head != nil {
+		v.rev = head.rev + 1
+		v.prev.Store(head)
+	}
+	r.head.Store(v)
+
+	kept = []*memVersion{v}
+	for old := v.prevVersion(); old != nil; old = old.prevVersion() {
+		kept = append(kept, old)
+		if old.ts <= oldest {
+			dropped = versionChain(old.prevVersion())
+			old.prev.Store((*memVersion)(nil))
+			break
+		}
+	}
+	return
+}
+
+// versionChain returns v and all versions before it
+func versionChain(v *memVersion) []*memVersion {
+	res := []*memVersion{}
+	for ; v != nil; v = v.prevVersion() {
+		res = append(res, v)
+	}
+	return res
+}
+
+// latestTs is the timestamp to see the latest committed versions, only valid
+// within clock.commit
+const latestTs = ^uint64(0)
+
+// memClock hands out commit timestamps and keeps track of active snapshots.
+// Writers are serialized by commit, readers only register their snapshot
+// timestamp and never wait for writers
+type memClock struct {
+	commitLock *sync.Mutex
+	committed  uint64
+
+	snapLock *sync.Mutex
+	active   map[uint64]int
+}
+
+func newMemClock() *memClock {
+	c := new(memClock)
+	c.commitLock = new(sync.Mutex)
+	c.snapLock = new(sync.Mutex)
+	c.active = map[uint64]int{}
+	return c
+}
+
+// acquire registers a snapshot at the latest committed timestamp. Every acquire
+// should be followed by release once the reader is done
+func (c *memClock) acquire() uint64 {
+	c.snapLock.Lock()
+	defer c.snapLock.Unlock()
+	ts := atomic.LoadUint64(&c.committed)
+	c.active[ts]++
+	return ts
+}
+
+func (c *memClock) release(ts uint64) {
+	c.snapLock.Lock()
+	defer c.snapLock.Unlock()
+	if c.active[ts] <= 1 {
+		delete(c.active, ts)
+		return
+	}
+	c.active[ts]--
+}
+
+// oldest returns the timestamp of the oldest snapshot that is still in use, or the
+// latest committed timestamp if there is none
+func (c *memClock) oldest() uint64 {
+	c.snapLock.Lock()
+	defer c.snapLock.Unlock()
+	res := atomic.LoadUint64(&c.committed)
+	for ts := range c.active {
+		if ts < res {
+			res = ts
+		}
+	}
+	return res
+}
+
+// commit runs fn with the timestamp of the next commit and publishes it when fn
+// returns without error. fn need to validate everything before writing any
+// version, since versions written by a failed commit become visible on the next one
+func (c *memClock) commit(fn func(ts uint64) error) error {
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+
+	ts := atomic.LoadUint64(&c.committed) + 1
+	if e := fn(ts); e != nil {
+		return e
+	}
+	atomic.StoreUint64(&c.committed, ts)
+	return nil
+}
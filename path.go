@@ -0,0 +1,321 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/eaciit/toolkit"
+)
+
+// getFieldValue returns value of a field of a record. Field could be a dotted path
+// like Address.City or Items.0.Qty, which is resolved through nested structs,
+// maps, toolkit.M and slices. A name that is not an index applied to a slice,
+// like Items.Qty, returns the values of that field of every element. An empty
+// field returns the record itself
+func getFieldValue(rec interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return rec, nil
+	}
+	rv, e := valueAt(reflect.ValueOf(rec), strings.Split(path, "."))
+	if e != nil {
+		return nil, fmt.Errorf("field %s is not found. %s", path, e.Error())
+	}
+	if !rv.IsValid() || !rv.CanInterface() {
+		return nil, fmt.Errorf("field %s is not accessible", path)
+	}
+	return rv.Interface(), nil
+}
+
+func valueAt(rv reflect.Value, names []string) (reflect.Value, error) {
+	for idx, name := range names {
+		elem := rv
+		for elem.IsValid() && (elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface) && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+			if _, e := strconv.Atoi(name); e != nil {
+				res := []interface{}{}
+				for i := 0; i < elem.Len(); i++ {
+					if v, e := valueAt(elem.Index(i), names[idx:]); e == nil && v.CanInterface() {
+						res = append(res, v.Interface())
+					}
+				}
+				return reflect.ValueOf(res), nil
+			}
+		}
+
+		var e error
+		if rv, e = fieldOf(rv, name); e != nil {
+			return reflect.Value{}, e
+		}
+	}
+	return rv, nil
+}
+
+func fieldOf(rv reflect.Value, name string) (reflect.Value, error) {
+	for rv.IsValid() && (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return reflect.Value{}, fmt.Errorf("%s is nil", name)
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return reflect.Value{}, fmt.Errorf("%s is nil", name)
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		fv := rv.FieldByName(name)
+		if !fv.IsValid() {
+			return reflect.Value{}, fmt.Errorf("%s is not a field of %s", name, rv.Type().String())
+		}
+		return fv, nil
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}, fmt.Errorf("%s: map key should be string", name)
+		}
+		fv := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !fv.IsValid() {
+			return reflect.Value{}, fmt.Errorf("%s is not a key of the map", name)
+		}
+		return fv, nil
+
+	case reflect.Slice, reflect.Array:
+		idx, e := strconv.Atoi(name)
+		if e != nil || idx < 0 || idx >= rv.Len() {
+			return reflect.Value{}, fmt.Errorf("%s is not a valid index", name)
+		}
+		return rv.Index(idx), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("%s can't be read from %s", name, rv.Kind().String())
+}
+
+// setFieldValue sets value of a field of a record, field could be a dotted path.
+// Nil pointers and maps along the path are created as needed
+func setFieldValue(rec interface{}, path string, value interface{}) error {
+	rv := reflect.ValueOf(rec)
+	if rv.Kind() == reflect.Map {
+		return setPath(rv, strings.Split(path, "."), value)
+	}
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("field %s can't be set, record should be a pointer or a map", path)
+	}
+	if e := setPath(rv.Elem(), strings.Split(path, "."), value); e != nil {
+		return fmt.Errorf("field %s can't be set. %s", path, e.Error())
+	}
+	return nil
+}
+
+// setPath sets value into rv following names, rv need to be settable unless it is a map
+func setPath(rv reflect.Value, names []string, value interface{}) error {
+	name := names[0]
+	last := len(names) == 1
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				return fmt.Errorf("%s is nil", name)
+			}
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return setPath(rv.Elem(), names, value)
+
+	case reflect.Interface:
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				return fmt.Errorf("%s is nil", name)
+			}
+			rv.Set(reflect.ValueOf(toolkit.M{}))
+		}
+		// values held by an interface are not addressable, so they are copied,
+		// changed and put back
+		elem := rv.Elem()
+		if elem.Kind() == reflect.Map || elem.Kind() == reflect.Ptr {
+			return setPath(elem, names, value)
+		}
+		cp := reflect.New(elem.Type()).Elem()
+		cp.Set(elem)
+		if e := setPath(cp, names, value); e != nil {
+			return e
+		}
+		if !rv.CanSet() {
+			return fmt.Errorf("%s can't be set", name)
+		}
+		rv.Set(cp)
+		return nil
+
+	case reflect.Struct:
+		fv := rv.FieldByName(name)
+		if !fv.IsValid() {
+			return fmt.Errorf("%s is not a field of %s", name, rv.Type().String())
+		}
+		if !fv.CanSet() {
+			return fmt.Errorf("%s can't be set", name)
+		}
+		if last {
+			return assignValue(fv, value)
+		}
+		return setPath(fv, names[1:], value)
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%s: map key should be string", name)
+		}
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				return fmt.Errorf("%s: map is nil", name)
+			}
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		key := reflect.ValueOf(name).Convert(rv.Type().Key())
+		fv := reflect.New(rv.Type().Elem()).Elem()
+		if !last {
+			if existing := rv.MapIndex(key); existing.IsValid() {
+				fv.Set(existing)
+			}
+			if e := setPath(fv, names[1:], value); e != nil {
+				return e
+			}
+		} else if e := assignValue(fv, value); e != nil {
+			return e
+		}
+		rv.SetMapIndex(key, fv)
+		return nil
+
+	case reflect.Slice, reflect.Array:
+		idx, e := strconv.Atoi(name)
+		if e == nil && idx >= rv.Len() && rv.Kind() == reflect.Slice && rv.CanSet() {
+			rv.Set(reflect.AppendSlice(rv, reflect.MakeSlice(rv.Type(), idx+1-rv.Len(), idx+1-rv.Len())))
+		}
+		if e != nil || idx < 0 || idx >= rv.Len() {
+			return fmt.Errorf("%s is not a valid index", name)
+		}
+		if last {
+			return assignValue(rv.Index(idx), value)
+		}
+		return setPath(rv.Index(idx), names[1:], value)
+	}
+
+	return fmt.Errorf("%s can't be set into %s", name, rv.Kind().String())
+}
+
+// assignValue sets value into target, converting it when the types are convertible
+func assignValue(target reflect.Value, value interface{}) error {
+	if value == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	vv := reflect.ValueOf(value)
+	switch {
+	case vv.Type().AssignableTo(target.Type()):
+		target.Set(vv)
+	case vv.Type().ConvertibleTo(target.Type()) && valueKind(vv) == valueKind(reflect.Zero(target.Type())):
+		target.Set(vv.Convert(target.Type()))
+	default:
+		return fmt.Errorf("%s is not assignable to %s", vv.Type().String(), target.Type().String())
+	}
+	return nil
+}
+
+// cloneRecord returns a deep copy of a record, so it can be modified without
+// touching the version held by the table
+func cloneRecord(rec interface{}) interface{} {
+	if rec == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(rec)).Interface()
+}
+
+// copyValue deep copies pointers, maps, slices and exported fields of structs
+func copyValue(rv reflect.Value) reflect.Value {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.New(rv.Type().Elem())
+		cp.Elem().Set(copyValue(rv.Elem()))
+		return cp
+
+	case reflect.Interface:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.New(rv.Type()).Elem()
+		cp.Set(copyValue(rv.Elem()))
+		return cp
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			cp.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return cp
+
+	case reflect.Slice:
+		if rv.IsNil() {
+			return rv
+		}
+		cp := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			cp.Index(i).Set(copyValue(rv.Index(i)))
+		}
+		return cp
+
+	case reflect.Struct:
+		cp := reflect.New(rv.Type()).Elem()
+		cp.Set(rv)
+		for i := 0; i < rv.NumField(); i++ {
+			if f := cp.Field(i); f.CanSet() {
+				f.Set(copyValue(rv.Field(i)))
+			}
+		}
+		return cp
+	}
+	return rv
+}
+
+// unsetFieldValue removes a key from a map or sets a struct field to its zero value,
+// field could be a dotted path. Unsetting a missing field does nothing
+func unsetFieldValue(rec interface{}, path string) error {
+	names := strings.Split(path, ".")
+	parent := reflect.ValueOf(rec)
+	if len(names) > 1 {
+		var e error
+		if parent, e = valueAt(parent, names[:len(names)-1]); e != nil {
+			return nil
+		}
+	}
+	for parent.IsValid() && (parent.Kind() == reflect.Ptr || parent.Kind() == reflect.Interface) && !parent.IsNil() {
+		parent = parent.Elem()
+	}
+
+	name := names[len(names)-1]
+	switch parent.Kind() {
+	case reflect.Map:
+		if parent.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("field %s can't be unset, map key should be string", path)
+		}
+		parent.SetMapIndex(reflect.ValueOf(name).Convert(parent.Type().Key()), reflect.Value{})
+
+	case reflect.Struct:
+		fv := parent.FieldByName(name)
+		if !fv.IsValid() {
+			return nil
+		}
+		if !fv.CanSet() {
+			return fmt.Errorf("field %s can't be unset", path)
+		}
+		fv.Set(reflect.Zero(fv.Type()))
+	}
+	return nil
+}
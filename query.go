@@ -4,157 +4,23 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
 
 	"git.kanosolution.net/kano/dbflex"
 	"git.kanosolution.net/kano/dbflex/orm"
 	"git.kanosolution.net/koloni/crowd"
-	"github.com/ariefdarmawan/reflector"
 	"github.com/eaciit/toolkit"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Query struct {
 	dbflex.QueryBase
 	conn *Connection
-}
-
-type MemFilterFunc func(ref *reflector.Reflector) bool
 
-func (qr *Query) BuildFilter(f *dbflex.Filter) (interface{}, error) {
-	var (
-		fn     MemFilterFunc
-		scanFn ScanFunc
-		e      error
-	)
-	fn, e = qr.buildFilterFunc(f)
-	if e != nil {
-		return nil, e
-	}
-	if fn != nil {
-		scanFn = ScanFunc(func(k string, r interface{}) (bool, interface{}) {
-			ref := reflector.From(r)
-			ok := fn(ref)
-			if ok {
-				return true, r
-			}
-			return false, nil
-		})
-		return scanFn, nil
-	}
-	return nil, nil
+	regexes map[string]*regexp.Regexp
 }
 
-func (qr *Query) buildFilterFunc(f *dbflex.Filter) (MemFilterFunc, error) {
-	fieldName := f.Field
-
-	switch f.Op {
-	case dbflex.OpAnd:
-		items := f.Items
-		fns := make([]MemFilterFunc, len(items))
-		for itemIdx, item := range items {
-			if buildItem, e := qr.BuildFilter(item); e == nil {
-				return nil, errors.New("error when creating filter. " + e.Error())
-			} else {
-				fns[itemIdx] = buildItem.(MemFilterFunc)
-			}
-		}
-
-		fn := func(ref *reflector.Reflector) bool {
-			for _, mf := range fns {
-				if !mf(ref) {
-					return false
-				}
-			}
-			return true
-		}
-
-		return MemFilterFunc(fn), nil
-
-	case dbflex.OpOr:
-		items := f.Items
-		fns := make([]MemFilterFunc, len(items))
-		for itemIdx, item := range items {
-			if buildItem, e := qr.BuildFilter(item); e == nil {
-				return nil, errors.New("error when creating filter. " + e.Error())
-			} else {
-				fns[itemIdx] = buildItem.(MemFilterFunc)
-			}
-		}
-
-		fn := func(ref *reflector.Reflector) bool {
-			for _, mf := range fns {
-				if mf(ref) {
-					return true
-				}
-			}
-			return false
-		}
-
-		return MemFilterFunc(fn), nil
-
-	case dbflex.OpEq:
-		fn := func(ref *reflector.Reflector) bool {
-			v, e := ref.Get(fieldName)
-			if e != nil {
-				return false
-			}
-			return v == f.Value
-		}
-		return MemFilterFunc(fn), nil
-
-	case dbflex.OpNe:
-		fn := func(ref *reflector.Reflector) bool {
-			v, e := ref.Get(fieldName)
-			if e != nil {
-				return false
-			}
-			return v != f.Value
-		}
-		return MemFilterFunc(fn), nil
-
-	case dbflex.OpGt:
-		return compare(fieldName, string(f.Op), f.Value), nil
-
-	case dbflex.OpGte:
-		return compare(fieldName, string(f.Op), f.Value), nil
-
-	case dbflex.OpLt:
-		return compare(fieldName, string(f.Op), f.Value), nil
-
-	case dbflex.OpLte:
-		return compare(fieldName, string(f.Op), f.Value), nil
-
-	case dbflex.OpRange:
-		return MemFilterFunc(func(ref *reflector.Reflector) bool {
-			v, e := ref.Get(fieldName)
-			if e != nil {
-				return false
-			}
-
-			rv := reflect.ValueOf(f.Value)
-			if rv.Kind() != reflect.Slice {
-				return false
-			}
-
-			if gte := toolkit.Compare(v, rv.Index(0).Interface(), "$gte"); gte {
-				return toolkit.Compare(v, rv.Index(1).Interface(), "lte")
-			}
-			return false
-		}), nil
-	}
-
-	return nil, nil
-}
-
-func compare(fieldName, op string, value interface{}) MemFilterFunc {
-	return MemFilterFunc(func(ref *reflector.Reflector) bool {
-		ret := false
-		v, e := ref.Get(fieldName)
-		if e != nil {
-			return ret
-		}
-		return toolkit.Compare(v, value, op)
-	})
+func (qr *Query) BuildFilter(f *dbflex.Filter) (interface{}, error) {
+	return qr.compileFilter(f)
 }
 
 func (qr *Query) BuildCommand() (interface{}, error) {
@@ -164,40 +30,45 @@ func (qr *Query) BuildCommand() (interface{}, error) {
 func (qr *Query) Cursor(parm toolkit.M) dbflex.ICursor {
 	cr := new(Cursor)
 
-	var (
-		hasTable bool
-		table    *memTable
-	)
-
 	tableName := qr.Config(dbflex.ConfigKeyTableName, "").(string)
 	if tableName == "" {
 		return cr.SetError(errors.New("tablename is missing"))
 	}
 
-	lock.RLock()
-	table, hasTable = tables[tableName]
-	lock.RUnlock()
-
-	if !hasTable {
-		return cr.SetError(fmt.Errorf("table %s is not registered yet", tableName))
+	table, e := qr.table(tableName, false, nil)
+	if e != nil {
+		return cr.SetError(e)
 	}
-
-	where, hasWhere := qr.Config(dbflex.ConfigKeyWhere, nil).(ScanFunc)
-	if !hasWhere {
-		cr.records = table.RecordsAsArray()
-	} else {
-		cScan := table.Scan(where)
-		for record := range cScan {
-			cr.records = append(cr.records, record)
-		}
+	if table == nil {
+		return cr
 	}
 
+	where, _ := qr.Config(dbflex.ConfigKeyWhere, nil).(*memFilter)
+	view := qr.tableView(table)
+
 	qis := qr.Config(dbflex.ConfigKeyGroupedQueryItems, dbflex.QueryItems{}).(dbflex.QueryItems)
 	groupObj, hasGroup := qis[dbflex.QueryGroup]
 	aggrObj, hasAggr := qis[dbflex.QueryAggr]
 
 	if !hasGroup && !hasAggr {
-		return cr
+		if selectObj, ok := qis[dbflex.QuerySelect]; ok {
+			cr.fields, _ = selectObj.Value.([]string)
+		}
+		if fields, limit, ok := sortLimit(qis); ok {
+			if records, sorted := view.FindSorted(where, fields, limit); sorted {
+				cr.records = records
+				return qr.arrange(cr, qis)
+			}
+		}
+	}
+
+	cScan := view.Find(where)
+	for record := range cScan {
+		cr.records = append(cr.records, record)
+	}
+
+	if !hasGroup && !hasAggr {
+		return qr.arrange(cr, qis)
 	}
 
 	datas := cr.records
@@ -206,8 +77,7 @@ func (qr *Query) Cursor(parm toolkit.M) dbflex.ICursor {
 		groupNames, ok := groupObj.Value.([]string)
 		if ok && len(groupNames) > 0 {
 			mre.Group(func(record interface{}) interface{} {
-				ref := reflector.From(record)
-				res, _ := ref.Get(groupNames[0])
+				res, _ := getFieldValue(record, groupNames[0])
 				return res
 			})
 		} else {
@@ -226,10 +96,8 @@ func (qr *Query) Cursor(parm toolkit.M) dbflex.ICursor {
 		mre.Map(func(k interface{}, vals []interface{}) toolkit.M {
 			m := toolkit.M{}.Set("Key", k)
 			for _, v := range vals {
-				dataRef := reflector.From(v)
-
 				for _, aggrItem := range aggrItems {
-					fv, e := dataRef.Get(aggrItem.Field)
+					fv, e := getFieldValue(v, aggrItem.Field)
 					if e != nil {
 						continue
 					}
@@ -298,23 +166,37 @@ func (qr *Query) Cursor(parm toolkit.M) dbflex.ICursor {
 		for idx, m := range recm {
 			cr.records[idx] = m
 		}
-		return cr
+		return qr.arrange(cr, qis)
 	}
 }
 
-func (qr *Query) Execute(m toolkit.M) (interface{}, error) {
-	var (
-		table        *memTable
-		hasTable, ok bool
-		odata        orm.DataModel
-		e            error
-	)
+// arrange applies order, skip and take of the query to the records of the cursor
+func (qr *Query) arrange(cr *Cursor, qis dbflex.QueryItems) dbflex.ICursor {
+	records, e := arrangeRecords(cr.records, qis)
+	if e != nil {
+		return cr.SetError(e)
+	}
+	cr.records = records
+	return cr
+}
+
+// tableView returns the table as seen by the connection of the query, which is
+// the transaction view when the connection is in a transaction
+func (qr *Query) tableView(table *memTable) tableView {
+	if qr.conn != nil && qr.conn.tx != nil {
+		return qr.conn.tx.table(table)
+	}
+	return table
+}
 
+func (qr *Query) Execute(m toolkit.M) (interface{}, error) {
 	parts := qr.Config(dbflex.ConfigKeyGroupedQueryItems, dbflex.QueryItems{}).(dbflex.QueryItems)
+	ct := qr.Config(dbflex.ConfigKeyCommandType, "N/A")
 	data, hasData := m["data"]
-	if hasData {
-		odata, ok = data.(orm.DataModel)
-		if !ok {
+	patch, isPatch := toM(data)
+	//-- delete ignores its data
+	if hasData && !isPatch && ct != dbflex.QueryDelete {
+		if _, ok := data.(orm.DataModel); !ok {
 			return nil, errors.New("data need to implements orm.datamodel")
 		}
 	}
@@ -324,78 +206,246 @@ func (qr *Query) Execute(m toolkit.M) (interface{}, error) {
 		return nil, errors.New("tablename is required")
 	}
 
+	upsert, _ := m[ParmUpsert].(bool)
+	create := ct == dbflex.QueryInsert || ct == dbflex.QuerySave || (ct == dbflex.QueryUpdate && upsert)
+	table, e := qr.table(tableName, create, data)
+	if e != nil {
+		return nil, e
+	}
+	if table == nil {
+		//-- a missing table in auto create mode has no records
+		switch ct {
+		case dbflex.QueryUpdate:
+			return new(UpdateResult), nil
+		case dbflex.QueryDelete:
+			return 0, nil
+		}
+		return nil, fmt.Errorf("command %v is not valid", ct)
+	}
+
 	lock.RLock()
-	table, hasTable = tables[tableName]
+	idGenerator := table.idGenerator
+	sequences := table.sequences
+	schemaless := table.model == nil
+	idField := table.idField
 	lock.RUnlock()
-
-	if !hasTable {
-		return nil, fmt.Errorf("table %s is not registered yet", tableName)
+	if idGenerator == nil && qr.conn != nil {
+		idGenerator = qr.conn.idGenerator
+	}
+	if isPatch && !schemaless && (ct == dbflex.QueryInsert || ct == dbflex.QuerySave) {
+		return nil, errors.New("data need to implements orm.datamodel")
 	}
 
-	where, _ := qr.Config(dbflex.ConfigKeyWhere, nil).(ScanFunc)
+	where, _ := qr.Config(dbflex.ConfigKeyWhere, nil).(*memFilter)
+
+	view := qr.tableView(table)
+	var (
+		version int64
+		ok      bool
+	)
+	parmVersion, hasVersion := m[ParmVersion]
+	if hasVersion {
+		if version, ok = toInt64(parmVersion); !ok {
+			return nil, fmt.Errorf("invalid %s parameter: %v", ParmVersion, parmVersion)
+		}
+	}
+	ops, e := updateOps(m[ParmOps])
+	if e != nil {
+		return nil, e
+	}
 
-	ct := qr.Config(dbflex.ConfigKeyCommandType, "N/A")
 	switch ct {
 	case dbflex.QueryInsert:
 		if !hasData {
 			return nil, errors.New("data is missing")
 		}
 
-		_, rids := odata.GetID(qr.Connection())
-		if rids[0].(string) == "" {
-			rids[0] = primitive.NewObjectID().Hex()
-			odata.SetID(rids...)
+		key, e := qr.newRecordKey(table, idField, idGenerator, sequences, data)
+		if e != nil {
+			return nil, e
 		}
-		if e = table.Set(rids[0].(string), data, false); e != nil {
+		//-- the table keeps its own copy, so the caller can't change a stored version
+		if e = view.Set(key, cloneRecord(data), false); e != nil {
 			return nil, e
 		}
-		return odata, nil
+		return data, nil
 
-	case dbflex.QueryUpdate:
+	case dbflex.QuerySave:
 		if !hasData {
 			return nil, errors.New("data is missing")
 		}
 
+		rids, e := qr.recordIDs(data, idField)
+		if e != nil {
+			return nil, e
+		}
+		key, e := table.recordKey(rids...)
+		exist := false
+		if e == nil && !isZeroID(rids) {
+			_, exist = view.Get(key)
+		}
+		if !exist {
+			key, e = qr.newRecordKey(table, idField, idGenerator, sequences, data)
+		}
+		if e != nil {
+			return nil, e
+		}
+		if e = qr.applyUpdateOps(data, ops, !exist); e != nil {
+			return nil, e
+		}
+
+		if hasVersion {
+			e = view.SetVersion(key, cloneRecord(data), version)
+		} else {
+			e = view.Set(key, cloneRecord(data), true)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return data, nil
+
+	case dbflex.QueryUpdate:
+		if !hasData && len(ops) == 0 {
+			return nil, errors.New("data is missing")
+		}
+
 		//-- get the field for update
 		pq, _ := parts[dbflex.QueryUpdate]
-		fieldNames := pq.Value.([]string)
-
-		cScan := table.Scan(where)
-		sourceRef := reflector.From(data)
-		for rec := range cScan {
-			targetRef := reflector.From(rec)
-			orec, recOK := rec.(orm.DataModel)
-			if !recOK {
+		fieldNames, _ := pq.Value.([]string)
+
+		//-- a map of changed fields is applied as operations
+		if isPatch {
+			patchOps, e := patchUpdateOps(patch, fieldNames)
+			if e != nil {
+				return nil, e
+			}
+			ops = append(patchOps, ops...)
+			data, hasData = nil, false
+		}
+
+		returnRecords, _ := m[ParmReturnRecords].(bool)
+		res := new(UpdateResult)
+		recs := collect(view.Find(where))
+		update := func(current interface{}) (interface{}, error) {
+			rec := cloneRecord(current)
+			if hasData {
+				//-- update all object with new one
+				if len(fieldNames) == 0 {
+					rec = cloneRecord(data)
+				} else { //or only certain field(s)
+					for _, fieldName := range fieldNames {
+						if getv, e := getFieldValue(data, fieldName); e == nil {
+							if e = setFieldValue(rec, fieldName, getv); e != nil {
+								return nil, e
+							}
+						}
+					}
+				}
+			}
+			if e := qr.applyUpdateOps(rec, ops, false); e != nil {
+				return nil, e
+			}
+			return rec, nil
+		}
+
+		mt, autoCommit := view.(*memTable)
+		for _, current := range recs {
+			rids, e := qr.recordIDs(current, idField)
+			if e != nil {
 				return nil, errors.New("invalid data to be updated")
 			}
+			key, e := table.recordKey(rids...)
+			if e != nil {
+				return nil, e
+			}
 
-			_, rids := orec.GetID(qr.Connection())
-			//-- update all object with new one
-			if len(fieldNames) == 0 {
-				table.Set(rids[0].(string), odata, true)
-			} else { //or only certain field(s)
-				for _, fieldName := range fieldNames {
-					if getv, e := sourceRef.Get(fieldName); e == nil {
-						targetRef.Set(fieldName, getv)
+			var rec interface{}
+			if autoCommit && !hasVersion {
+				//-- outside of a transaction the update is applied to the latest version
+				//-- of the record and retried when another writer changed it meanwhile
+				found := true
+				for {
+					var latest int64
+					current, latest, found = mt.getVersion(key)
+					if !found || (where != nil && !where.Match(current)) {
+						found = false
+						break
+					}
+					if rec, e = update(current); e != nil {
+						return nil, e
+					}
+					if e = mt.SetVersion(key, rec, latest); !IsVersionConflict(e) {
+						break
 					}
 				}
-				targetRef.Flush()
-				table.Set(rids[0].(string), rec, true)
+				if !found {
+					continue
+				}
+			} else {
+				if rec, e = update(current); e != nil {
+					return nil, e
+				}
+				if hasVersion {
+					e = view.SetVersion(key, rec, version)
+				} else {
+					e = view.Set(key, rec, true)
+				}
+			}
+			if e != nil {
+				return nil, e
+			}
+
+			res.Matched++
+			if !reflect.DeepEqual(current, rec) {
+				res.Modified++
+			}
+			if returnRecords {
+				res.Records = append(res.Records, cloneRecord(rec))
 			}
 		}
 
-		return odata, nil
+		if len(recs) == 0 && upsert {
+			rec, e := qr.upsertRecord(table, where, data)
+			if e != nil {
+				return nil, e
+			}
+			if e = qr.applyUpdateOps(rec, ops, true); e != nil {
+				return nil, e
+			}
+			key, e := qr.newRecordKey(table, idField, idGenerator, sequences, rec)
+			if e != nil {
+				return nil, e
+			}
+			if e = view.Set(key, rec, false); e != nil {
+				return nil, e
+			}
+			res.UpsertedKey = key
+			if returnRecords {
+				res.Records = append(res.Records, cloneRecord(rec))
+			}
+		}
+
+		return res, nil
 
 	case dbflex.QueryDelete:
 		deletedCount := 0
-		cScan := table.Scan(where)
-		for rec := range cScan {
-			orec, recOK := rec.(orm.DataModel)
-			if !recOK {
+		recs := collect(view.Find(where))
+		for _, rec := range recs {
+			rids, e := qr.recordIDs(rec, idField)
+			if e != nil {
 				continue
 			}
-			_, rids := orec.GetID(qr.Connection())
-			table.Delete(rids[0].(string))
+			key, e := table.recordKey(rids...)
+			if e != nil {
+				return deletedCount, e
+			}
+			if hasVersion {
+				if e = view.DeleteVersion(key, version); e != nil {
+					return deletedCount, e
+				}
+			} else {
+				view.Delete(key)
+			}
 			deletedCount++
 		}
 		return deletedCount, nil
@@ -404,3 +454,115 @@ func (qr *Query) Execute(m toolkit.M) (interface{}, error) {
 		return nil, fmt.Errorf("command %v is not valid", ct)
 	}
 }
+
+// newRecordKey prepares the ID of a record to be inserted and returns its key.
+// Sequences bound to the table are applied first, then an ID that is still
+// empty is generated
+func (qr *Query) newRecordKey(table *memTable, idField string, gen IDGenerator, seqs []Sequence, rec interface{}) (string, error) {
+	rids, e := qr.recordIDs(rec, idField)
+	if e != nil {
+		return "", e
+	}
+	if len(seqs) > 0 {
+		ids, e := qr.applySequences(seqs, rec, rids)
+		if e != nil {
+			return "", e
+		}
+		if !isZeroID(ids) && isZeroID(rids) {
+			setRecordID(rec, idField, ids)
+		}
+		rids = ids
+	}
+
+	if isZeroID(rids) {
+		if rids, e = generateID(gen, table.name, rids); e != nil {
+			return "", e
+		}
+		setRecordID(rec, idField, rids)
+	}
+	return table.recordKey(rids...)
+}
+
+// recordIDs returns the values of the ID fields of a record, which is either an
+// orm.DataModel or a document of a schemaless table having its ID in idField
+func (qr *Query) recordIDs(rec interface{}, idField string) ([]interface{}, error) {
+	if orec, ok := rec.(orm.DataModel); ok {
+		_, rids := orec.GetID(qr.Connection())
+		return rids, nil
+	}
+	if doc, ok := toM(rec); ok {
+		return []interface{}{doc[idField]}, nil
+	}
+	return nil, fmt.Errorf("record of type %T has no id", rec)
+}
+
+func setRecordID(rec interface{}, idField string, ids []interface{}) {
+	if orec, ok := rec.(orm.DataModel); ok {
+		orec.SetID(ids...)
+	} else if doc, ok := toM(rec); ok {
+		doc[idField] = ids[0]
+	}
+}
+
+// table returns the table of the query. In auto create mode a missing table is
+// created when create is set, taking the type of data as its model when data is
+// an orm.DataModel, otherwise nil is returned
+func (qr *Query) table(tableName string, create bool, data interface{}) (*memTable, error) {
+	if db, ok := qr.lookupDatabase(); ok {
+		if table, ok := db.table(tableName); ok {
+			return table, nil
+		}
+	}
+
+	if qr.conn == nil || !qr.conn.autoCreate {
+		return nil, fmt.Errorf("table %s is not registered yet", tableName)
+	}
+	if !create {
+		return nil, nil
+	}
+
+	var model reflect.Type
+	if _, isModel := data.(orm.DataModel); isModel {
+		model = reflect.TypeOf(data)
+	}
+	return qr.database().ensureTable(tableName, model, qr.conn.idField), nil
+}
+
+// database returns the database of the connection of the query, creating it
+// when it doesn't exist yet
+func (qr *Query) database() *memDatabase {
+	return getDatabase(qr.databaseName())
+}
+
+// lookupDatabase returns the database of the connection of the query without
+// creating it
+func (qr *Query) lookupDatabase() (*memDatabase, bool) {
+	return lookupDatabase(qr.databaseName())
+}
+
+func (qr *Query) databaseName() string {
+	if qr.conn == nil {
+		return ""
+	}
+	return qr.conn.Database
+}
+
+// toInt64 converts any integer value to int64
+func toInt64(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+func collect(c <-chan interface{}) []interface{} {
+	res := []interface{}{}
+	for rec := range c {
+		res = append(res, rec)
+	}
+	return res
+}
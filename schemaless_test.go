@@ -0,0 +1,135 @@
+package flexmem_test
+
+import (
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSchemaless(t *testing.T) {
+	t.Parallel()
+	convey.Convey("schemaless tables", t, func() {
+		conn := flexmemtest.NewWithConfig(t, toolkit.M{}.Set(flexmem.ConfigAutoCreate, true))
+
+		convey.Convey("first insert creates the table", func() {
+			convey.So(conn.HasTable("events"), convey.ShouldBeFalse)
+			_, e := conn.Execute(dbflex.From("events").Insert(), toolkit.M{}.Set("data", toolkit.M{"_id": "e1", "Kind": "click", "Score": 3}))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(conn.HasTable("events"), convey.ShouldBeTrue)
+
+			doc := toolkit.M{"Kind": "view", "Score": 1}
+			_, e = conn.Execute(dbflex.From("events").Insert(), toolkit.M{}.Set("data", doc))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(doc["_id"], convey.ShouldHaveSameTypeAs, primitive.ObjectID{})
+
+			_, e = conn.Execute(dbflex.From("events").Insert(), toolkit.M{}.Set("data", toolkit.M{"_id": "e1"}))
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+
+			convey.Convey("documents are queried like collections", func() {
+				docs := []toolkit.M{}
+				e := conn.Cursor(dbflex.From("events").Where(dbflex.Gte("Score", 1)).OrderBy("-Score").Select(), nil).Fetchs(&docs, 0).Close()
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(len(docs), convey.ShouldEqual, 2)
+				convey.So(docs[0]["_id"], convey.ShouldEqual, "e1")
+				convey.So(docs[1]["Kind"], convey.ShouldEqual, "view")
+			})
+
+			convey.Convey("documents are updated, saved and deleted", func() {
+				res, e := conn.Execute(dbflex.From("events").Where(dbflex.Eq("Kind", "click")).Update(), toolkit.M{}.Set("data", toolkit.M{"Score": 5}))
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(res.(*flexmem.UpdateResult).Modified, convey.ShouldEqual, 1)
+
+				_, e = conn.Execute(dbflex.From("events").Save(), toolkit.M{}.Set("data", toolkit.M{"_id": "e1", "Kind": "dblclick"}))
+				convey.So(e, convey.ShouldBeNil)
+				doc := toolkit.M{}
+				conn.Cursor(dbflex.From("events").Where(dbflex.Eq("_id", "e1")).Select(), nil).Fetch(&doc).Close()
+				convey.So(doc, convey.ShouldResemble, toolkit.M{"_id": "e1", "Kind": "dblclick"})
+
+				n, e := conn.Execute(dbflex.From("events").Where(dbflex.Eq("Kind", "view")).Delete(), nil)
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(n, convey.ShouldEqual, 1)
+			})
+		})
+
+		convey.Convey("missing tables have no records", func() {
+			cur := conn.Cursor(dbflex.From("visits").Select(), nil)
+			convey.So(cur.Error(), convey.ShouldBeNil)
+			convey.So(cur.Count(), convey.ShouldEqual, 0)
+
+			n, e := conn.Execute(dbflex.From("visits").Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(n, convey.ShouldEqual, 0)
+			convey.So(conn.HasTable("visits"), convey.ShouldBeFalse)
+
+			res, e := conn.Execute(dbflex.From("visits").Where(dbflex.Eq("Page", "home")).Update(), toolkit.M{}.
+				Set(flexmem.ParmOps, flexmem.Inc("Count", 1)).Set(flexmem.ParmUpsert, true))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(res.(*flexmem.UpdateResult).UpsertedKey, convey.ShouldNotBeEmpty)
+			doc := toolkit.M{}
+			conn.Cursor(dbflex.From("visits").Select(), nil).Fetch(&doc).Close()
+			convey.So(doc["Page"], convey.ShouldEqual, "home")
+			convey.So(doc["Count"], convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("id field is configurable", func() {
+			conn := flexmemtest.NewWithConfig(t, toolkit.M{}.
+				Set(flexmem.ConfigAutoCreate, "true").Set(flexmem.ConfigIDField, "Code"))
+			conn.SetIDGenerator(flexmem.SequentialGenerator(10))
+
+			doc := toolkit.M{"Page": "about"}
+			_, e := conn.Execute(dbflex.From("visits").Insert(), toolkit.M{}.Set("data", doc))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(doc["Code"], convey.ShouldEqual, int64(10))
+		})
+
+		convey.Convey("sequence bound to the id", func() {
+			convey.So(conn.EnsureTable("docs", nil, nil), convey.ShouldBeNil)
+			convey.So(conn.EnsureSequence(flexmem.Sequence{Table: "docs"}), convey.ShouldBeNil)
+			for i := 1; i <= 2; i++ {
+				doc := toolkit.M{"name": "x"}
+				_, e := conn.Execute(dbflex.From("docs").Insert(), toolkit.M{}.Set("data", doc))
+				convey.So(e, convey.ShouldBeNil)
+				convey.So(doc["_id"], convey.ShouldEqual, int64(i))
+			}
+		})
+
+		convey.Convey("ids of different types", func() {
+			for _, id := range []interface{}{1, "1", "#int:1"} {
+				_, e := conn.Execute(dbflex.From("tags").Insert(), toolkit.M{}.Set("data", toolkit.M{"_id": id, "Name": "first"}))
+				convey.So(e, convey.ShouldBeNil)
+			}
+			_, e := conn.Execute(dbflex.From("tags").Insert(), toolkit.M{}.Set("data", toolkit.M{"_id": 1}))
+			convey.So(flexmem.IsDuplicateKey(e), convey.ShouldBeTrue)
+
+			_, e = conn.Execute(dbflex.From("tags").Save(), toolkit.M{}.Set("data", toolkit.M{"_id": "1", "Name": "saved"}))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(conn.Cursor(dbflex.From("tags").Select(), nil).Count(), convey.ShouldEqual, 3)
+			doc := toolkit.M{}
+			conn.Cursor(dbflex.From("tags").Where(dbflex.Eq("_id", 1)).Select(), nil).Fetch(&doc).Close()
+			convey.So(doc["Name"], convey.ShouldEqual, "first")
+
+			key, _ := flexmem.DocumentKey(1)
+			version, _ := conn.RecordVersion("tags", key)
+			convey.So(version, convey.ShouldEqual, 1)
+			version, _ = conn.RecordVersion("tags", "1")
+			convey.So(version, convey.ShouldEqual, 2)
+		})
+
+		convey.Convey("registered tables still need models", func() {
+			convey.So(conn.RegisterObject(new(Order)), convey.ShouldBeNil)
+			_, e := conn.Execute(dbflex.From("orders").Insert(), toolkit.M{}.Set("data", toolkit.M{"ID": "order-9"}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("auto create is opt in", func() {
+			conn := flexmemtest.New(t)
+			_, e := conn.Execute(dbflex.From("visits").Insert(), toolkit.M{}.Set("data", toolkit.M{"Page": "home"}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Sequence is a named counter. When bound to a table, records inserted into the
+// table with the zero value in Field get the next value of the counter, an empty
+// Field binds the sequence to the ID of the table. Start and Step default to 1.
+//
+// Counters are stored as versioned records, so values taken in a transaction are
+// given back on rollback, and committing fails with a VersionConflictError when
+// another connection took a value of the same sequence in the meantime
+type Sequence struct {
+	Name  string
+	Table string
+	Field string
+	Start int64
+	Step  int64
+}
+
+func (seq Sequence) normalize() Sequence {
+	if seq.Name == "" {
+		field := seq.Field
+		if field == "" {
+			field = "ID"
+		}
+		seq.Name = seq.Table + "_" + field
+	}
+	if seq.Start == 0 {
+		seq.Start = 1
+	}
+	if seq.Step == 0 {
+		seq.Step = 1
+	}
+	return seq
+}
+
+// EnsureSequence declares a sequence and binds it to its table if Table is set.
+// Declaring the sequence again changes its binding but keeps the counter value
+func (conn *Connection) EnsureSequence(seq Sequence) error {
+	seq = seq.normalize()
+
+	//-- the database is only created for a sequence without table
+	if _, ok := conn.table(seq.Table); !ok && seq.Table != "" {
+		return fmt.Errorf("table %s is not registered yet", seq.Table)
+	}
+
+	db := conn.database()
+	lock.Lock()
+	defer lock.Unlock()
+	if seq.Table != "" {
+		table, ok := db.tables[seq.Table]
+		if !ok {
+			return fmt.Errorf("table %s is not registered yet", seq.Table)
+		}
+		bound := []Sequence{seq}
+		for _, other := range table.sequences {
+			if other.Field != seq.Field {
+				bound = append(bound, other)
+			}
+		}
+		table.sequences = bound
+	}
+	db.sequenceDefs[seq.Name] = seq
+	return nil
+}
+
+// NextSequence takes the next value of a sequence, sequences that have not been
+// declared start from 1
+func (conn *Connection) NextSequence(name string) (int64, error) {
+	db := conn.database()
+	lock.RLock()
+	seq, ok := db.sequenceDefs[name]
+	lock.RUnlock()
+	if !ok {
+		seq = Sequence{Name: name}.normalize()
+	}
+
+	var view tableView = db.sequenceTable
+	if conn.tx != nil {
+		view = conn.tx.table(db.sequenceTable)
+	}
+	return nextSequence(view, seq)
+}
+
+// nextSequence increments the counter of the sequence. Outside of a transaction
+// it retries until no other writer has taken the same value
+func nextSequence(view tableView, seq Sequence) (int64, error) {
+	for {
+		version, exist := view.Version(seq.Name)
+		value := seq.Start
+		if exist {
+			current, _ := view.Get(seq.Name)
+			value = current.(int64) + seq.Step
+		}
+
+		var e error
+		if exist {
+			e = view.SetVersion(seq.Name, value, version)
+		} else {
+			e = view.Set(seq.Name, value, false)
+		}
+		if e == nil {
+			return value, nil
+		}
+		if _, inTx := view.(*txTable); inTx || !(IsVersionConflict(e) || IsDuplicateKey(e)) {
+			return 0, e
+		}
+	}
+}
+
+// applySequences assigns the next value of the sequences bound to the table to
+// the empty fields of data, and returns the ID when a sequence is bound to it
+func (qr *Query) applySequences(seqs []Sequence, data interface{}, rids []interface{}) ([]interface{}, error) {
+	view := qr.tableView(qr.database().sequenceTable)
+	for _, seq := range seqs {
+		if seq.Field == "" {
+			if len(rids) != 1 || !isZeroID(rids) {
+				continue
+			}
+			value, e := nextSequence(view, seq)
+			if e != nil {
+				return nil, e
+			}
+			//-- a document without ID takes the value as is
+			var id interface{} = value
+			if rids[0] != nil {
+				if id, e = convertID(value, reflect.TypeOf(rids[0])); e != nil {
+					return nil, e
+				}
+			}
+			rids = []interface{}{id}
+			continue
+		}
+
+		current, e := getFieldValue(data, seq.Field)
+		if e != nil {
+			return nil, e
+		}
+		if rv := reflect.ValueOf(current); rv.IsValid() && !rv.IsZero() {
+			continue
+		}
+		value, e := nextSequence(view, seq)
+		if e != nil {
+			return nil, e
+		}
+		if e = setFieldValue(data, seq.Field, value); e != nil {
+			return nil, e
+		}
+	}
+	return rids, nil
+}
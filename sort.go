@@ -0,0 +1,269 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"git.kanosolution.net/kano/dbflex"
+)
+
+type sortField struct {
+	name string
+	desc bool
+}
+
+func parseSortFields(fields []string) []sortField {
+	res := []sortField{}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		sf := sortField{name: field}
+		if strings.HasPrefix(field, "-") {
+			sf.name = field[1:]
+			sf.desc = true
+		} else if strings.HasPrefix(field, "+") {
+			sf.name = field[1:]
+		}
+		res = append(res, sf)
+	}
+	return res
+}
+
+// arrangeRecords applies order, skip and take query items to the records
+func arrangeRecords(records []interface{}, qis dbflex.QueryItems) ([]interface{}, error) {
+	if orderObj, ok := qis[dbflex.QueryOrder]; ok {
+		fields, ok := orderObj.Value.([]string)
+		if !ok {
+			return nil, fmt.Errorf("invalid order by value: %v", orderObj.Value)
+		}
+		sortRecords(records, parseSortFields(fields))
+	}
+
+	if skipObj, ok := qis[dbflex.QuerySkip]; ok {
+		skip, ok := toInt64(skipObj.Value)
+		if !ok || skip < 0 {
+			return nil, fmt.Errorf("invalid skip value: %v", skipObj.Value)
+		}
+		if int(skip) >= len(records) {
+			records = records[:0]
+		} else {
+			records = records[skip:]
+		}
+	}
+
+	if takeObj, ok := qis[dbflex.QueryTake]; ok {
+		take, ok := toInt64(takeObj.Value)
+		if !ok || take < 0 {
+			return nil, fmt.Errorf("invalid take value: %v", takeObj.Value)
+		}
+		if take > 0 && int(take) < len(records) {
+			records = records[:take]
+		}
+	}
+
+	return records, nil
+}
+
+// sortLimit returns the order fields and the number of records needed to apply
+// skip and take, when the query is ordered and takes a limited number of records
+func sortLimit(qis dbflex.QueryItems) ([]sortField, int, bool) {
+	orderObj, hasOrder := qis[dbflex.QueryOrder]
+	takeObj, hasTake := qis[dbflex.QueryTake]
+	if !hasOrder || !hasTake {
+		return nil, 0, false
+	}
+	orderFields, ok := orderObj.Value.([]string)
+	if !ok {
+		return nil, 0, false
+	}
+	fields := parseSortFields(orderFields)
+	take, ok := toInt64(takeObj.Value)
+	if !ok || take <= 0 || len(fields) == 0 {
+		return nil, 0, false
+	}
+
+	var skip int64
+	if skipObj, hasSkip := qis[dbflex.QuerySkip]; hasSkip {
+		if skip, ok = toInt64(skipObj.Value); !ok || skip < 0 {
+			return nil, 0, false
+		}
+	}
+	return fields, int(skip + take), true
+}
+
+func sortRecords(records []interface{}, fields []sortField) {
+	if len(fields) == 0 {
+		return
+	}
+
+	keys := make([][]interface{}, len(records))
+	for i, rec := range records {
+		keys[i] = make([]interface{}, len(fields))
+		for fi, f := range fields {
+			keys[i][fi], _ = getFieldValue(rec, f.name)
+		}
+	}
+
+	idxs := make([]int, len(records))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	sort.SliceStable(idxs, func(a, b int) bool {
+		ka, kb := keys[idxs[a]], keys[idxs[b]]
+		for fi, f := range fields {
+			c := compareValue(ka[fi], kb[fi])
+			if c == 0 {
+				continue
+			}
+			if f.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	sorted := make([]interface{}, len(records))
+	for i, idx := range idxs {
+		sorted[i] = records[idx]
+	}
+	copy(records, sorted)
+}
+
+// compareValue returns -1, 0 or 1 when a is less, equal or greater than b. nil is less
+// than any value, and values of different kind are ordered by their kind
+func compareValue(a, b interface{}) int {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	ka, kb := valueKind(va), valueKind(vb)
+	if ka != kb {
+		return compareInt(int64(ka), int64(kb))
+	}
+
+	switch ka {
+	case kindNil:
+		return 0
+
+	case kindNumber:
+		switch {
+		case isInt(va) && isInt(vb):
+			return compareInt(va.Int(), vb.Int())
+		case isUint(va) && isUint(vb):
+			return compareUint(va.Uint(), vb.Uint())
+		}
+		return compareFloat(toFloat(va), toFloat(vb))
+
+	case kindString:
+		return strings.Compare(va.String(), vb.String())
+
+	case kindBool:
+		return compareInt(boolToInt(va.Bool()), boolToInt(vb.Bool()))
+
+	case kindTime:
+		ta, tb := a.(time.Time), b.(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+const (
+	kindNil = iota
+	kindNumber
+	kindString
+	kindBool
+	kindTime
+	kindOther
+)
+
+func valueKind(v reflect.Value) int {
+	if !v.IsValid() {
+		return kindNil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return kindNumber
+	case reflect.String:
+		return kindString
+	case reflect.Bool:
+		return kindBool
+	}
+	if _, ok := v.Interface().(time.Time); ok {
+		return kindTime
+	}
+	return kindOther
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -3,38 +3,117 @@ package flexmem
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
+
+	"github.com/eaciit/toolkit"
 )
 
+type memTombstone struct {
+	key string
+	ts  uint64
+}
+
+// memTable keeps every record as a chain of versions. Readers scan the table at
+// a snapshot timestamp and never block writers, while writers are serialized
+// by the commit clock
 type memTable struct {
-	lock    *sync.RWMutex
-	records map[string]interface{}
+	records    *sync.Map
+	tombstones []memTombstone
+
+	indexLock *sync.RWMutex
+	indexes   []memIndex
+
+	// model is the type of the object registered for the table, a table without
+	// model is schemaless and keeps toolkit.M documents identified by idField
+	model   reflect.Type
+	idField string
+
+	// idGenerator, sequences and dropped are guarded by the package lock
+	idGenerator IDGenerator
+	sequences   []Sequence
+	dropped     bool
 
 	name string
 }
 
 func newMemTable() *memTable {
 	mt := new(memTable)
-	mt.lock = new(sync.RWMutex)
-	mt.records = map[string]interface{}{}
+	mt.records = new(sync.Map)
+	mt.indexLock = new(sync.RWMutex)
 	return mt
 }
 
+// newRecord returns a new zero record of the registered model of the table, or
+// an empty document for a schemaless table
+func (m *memTable) newRecord() (interface{}, error) {
+	if m.model == nil {
+		return toolkit.M{}, nil
+	}
+	if m.model.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("table %s has no registered model", m.name)
+	}
+	return reflect.New(m.model.Elem()).Interface(), nil
+}
+
 func (m *memTable) GetID(data interface{}) (string, error) {
 	return "", errors.New("error on obtaining id for " + m.name)
 }
 
 func (m *memTable) Get(key string) (interface{}, bool) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	data, ok := m.records[key]
-	return data, ok
+	ts := clock.acquire()
+	defer clock.release(ts)
+	return m.GetAt(key, ts)
+}
+
+// GetAt returns the record with given key as it was at timestamp ts
+func (m *memTable) GetAt(key string, ts uint64) (interface{}, bool) {
+	rec, ok := m.records.Load(key)
+	if !ok {
+		return nil, false
+	}
+	v := rec.(*memRecord).at(ts)
+	if v == nil || v.deleted {
+		return nil, false
+	}
+	return v.data, true
+}
+
+// Version returns the current version of a record, which starts at 1 on insert
+// and is incremented on every write
+func (m *memTable) Version(key string) (int64, bool) {
+	ts := clock.acquire()
+	defer clock.release(ts)
+	return m.VersionAt(key, ts)
+}
+
+// getVersion returns the latest record with given key together with its version
+func (m *memTable) getVersion(key string) (interface{}, int64, bool) {
+	ts := clock.acquire()
+	defer clock.release(ts)
+	data, ok := m.GetAt(key, ts)
+	if !ok {
+		return nil, 0, false
+	}
+	version, _ := m.VersionAt(key, ts)
+	return data, version, true
+}
+
+// VersionAt returns the version of a record as it was at timestamp ts
+func (m *memTable) VersionAt(key string, ts uint64) (int64, bool) {
+	rec, ok := m.records.Load(key)
+	if !ok {
+		return 0, false
+	}
+	v := rec.(*memRecord).at(ts)
+	if v == nil || v.deleted {
+		return 0, false
+	}
+	return v.rev, true
 }
 
 func (m *memTable) GetWithDefault(key string, def interface{}) (interface{}, bool) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	data, ok := m.records[key]
+	data, ok := m.Get(key)
 	if !ok {
 		return def, ok
 	}
@@ -42,45 +121,214 @@ func (m *memTable) GetWithDefault(key string, def interface{}) (interface{}, boo
 }
 
 func (m *memTable) Set(key string, data interface{}, upsert bool) error {
-	m.lock.RLock()
-	_, ok := m.records[key]
-	m.lock.RUnlock()
+	return clock.commit(func(ts uint64) error {
+		if _, ok := m.latest(key); ok && !upsert {
+			return &DuplicateKeyError{Table: m.name, Key: key}
+		}
+		if e := m.checkUnique(latestTs, key, data, nil); e != nil {
+			return e
+		}
+		m.write(key, data, false, ts)
+		return nil
+	})
+}
 
-	if ok && !upsert {
-		return fmt.Errorf("record already exists with key '%s'", key)
-	}
+func (m *memTable) Delete(key string) {
+	clock.commit(func(ts uint64) error {
+		if _, ok := m.latest(key); ok {
+			m.write(key, nil, true, ts)
+		}
+		return nil
+	})
+}
 
-	m.lock.Lock()
-	m.records[key] = data
-	m.lock.Unlock()
+// SetVersion replaces a record only if its current version is the given version
+func (m *memTable) SetVersion(key string, data interface{}, version int64) error {
+	return clock.commit(func(ts uint64) error {
+		if e := m.checkVersion(key, version); e != nil {
+			return e
+		}
+		if e := m.checkUnique(latestTs, key, data, nil); e != nil {
+			return e
+		}
+		m.write(key, data, false, ts)
+		return nil
+	})
+}
+
+// DeleteVersion deletes a record only if its current version is the given version
+func (m *memTable) DeleteVersion(key string, version int64) error {
+	return clock.commit(func(ts uint64) error {
+		if e := m.checkVersion(key, version); e != nil {
+			return e
+		}
+		m.write(key, nil, true, ts)
+		return nil
+	})
+}
 
+// checkVersion validates the latest committed version of a record, it should only
+// be called within clock.commit
+func (m *memTable) checkVersion(key string, version int64) error {
+	if rev := m.latestVersion(key); rev != version {
+		return &VersionConflictError{Table: m.name, Key: key, Expected: version, Actual: rev}
+	}
 	return nil
 }
 
-func (m *memTable) Delete(key string) {
-	m.lock.Lock()
-	delete(m.records, key)
-	m.lock.Unlock()
+// latestVersion returns the version of the latest committed record or 0 if the record
+// does not exist, it should only be called within clock.commit
+func (m *memTable) latestVersion(key string) int64 {
+	rec, ok := m.records.Load(key)
+	if !ok {
+		return 0
+	}
+	v := rec.(*memRecord).latest()
+	if v == nil || v.deleted {
+		return 0
+	}
+	return v.rev
+}
+
+// latest returns the latest committed version of a record, it should only be
+// called within clock.commit
+func (m *memTable) latest(key string) (interface{}, bool) {
+	rec, ok := m.records.Load(key)
+	if !ok {
+		return nil, false
+	}
+	v := rec.(*memRecord).latest()
+	if v == nil || v.deleted {
+		return nil, false
+	}
+	return v.data, true
+}
+
+// write adds a new version of a record, it should only be called within clock.commit
+func (m *memTable) write(key string, data interface{}, deleted bool, ts uint64) {
+	oldest := clock.oldest()
+
+	rec, ok := m.records.Load(key)
+	if !ok {
+		rec = new(memRecord)
+		m.records.Store(key, rec)
+	}
+	v := &memVersion{ts: ts, data: data, deleted: deleted}
+	dropped, kept := rec.(*memRecord).push(v, oldest)
+	m.indexVersion(key, v, dropped, kept)
+	if deleted {
+		m.tombstones = append(m.tombstones, memTombstone{key, ts})
+	}
+
+	m.vacuum(oldest)
+}
+
+// vacuum removes records which have been deleted before any active snapshot
+func (m *memTable) vacuum(oldest uint64) {
+	n := 0
+	for _, tomb := range m.tombstones {
+		if tomb.ts > oldest {
+			break
+		}
+		n++
+		rec, ok := m.records.Load(tomb.key)
+		if !ok {
+			continue
+		}
+		if v := rec.(*memRecord).latest(); v != nil && v.deleted && v.ts == tomb.ts {
+			m.records.Delete(tomb.key)
+			m.indexVersion(tomb.key, nil, versionChain(v), nil)
+		}
+	}
+	if n > 0 {
+		m.tombstones = append(m.tombstones[:0], m.tombstones[n:]...)
+	}
 }
 
 type ScanFunc func(key string, record interface{}) (bool, interface{})
 
 func (m *memTable) Scan(fn ScanFunc) <-chan interface{} {
+	ts := clock.acquire()
+	return m.scan(ts, nil, fn, func() {
+		clock.release(ts)
+	})
+}
+
+// ScanAt scans the records as they were at timestamp ts, the snapshot of ts
+// should be held by the caller until the scan is completed
+func (m *memTable) ScanAt(ts uint64, fn ScanFunc) <-chan interface{} {
+	return m.scan(ts, nil, fn, nil)
+}
+
+// Find returns records matching the filter, using the indexes of the table
+// when the filter allows it
+func (m *memTable) Find(where *memFilter) <-chan interface{} {
+	ts := clock.acquire()
+	return m.FindAt(ts, where, nil, func() {
+		clock.release(ts)
+	})
+}
+
+// FindAt returns records matching the filter as they were at timestamp ts. Records
+// with key for which skip returns true are excluded, and done is called once the
+// scan is completed
+func (m *memTable) FindAt(ts uint64, where *memFilter, skip func(key string) bool, done func()) <-chan interface{} {
+	match := where.scanFunc()
+	fn := match
+	if skip != nil {
+		fn = func(k string, r interface{}) (bool, interface{}) {
+			if skip(k) {
+				return false, nil
+			}
+			if match == nil {
+				return true, r
+			}
+			return match(k, r)
+		}
+	}
+
+	keys, indexed := m.candidates(where)
+	if !indexed {
+		keys = nil
+	} else if keys == nil {
+		keys = []string{}
+	}
+	return m.scan(ts, keys, fn, done)
+}
+
+// scan iterates the records visible at timestamp ts, or only the records with
+// given keys when keys is not nil
+func (m *memTable) scan(ts uint64, keys []string, fn ScanFunc, done func()) <-chan interface{} {
 	c := make(chan interface{})
 
+	visit := func(k string, rec *memRecord) {
+		v := rec.at(ts)
+		if v == nil || v.deleted {
+			return
+		}
+		if fn == nil {
+			c <- v.data
+		} else if ok, ret := fn(k, v.data); ok {
+			c <- ret
+		}
+	}
+
 	go func() {
-		m.lock.RLock()
-		records := m.records
-		m.lock.RUnlock()
-		for k, r := range records {
-			if fn == nil {
-				c <- r
-			} else {
-				if ok, ret := fn(k, r); ok {
-					c <- ret
+		if keys == nil {
+			m.records.Range(func(k, rec interface{}) bool {
+				visit(k.(string), rec.(*memRecord))
+				return true
+			})
+		} else {
+			for _, k := range keys {
+				if rec, ok := m.records.Load(k); ok {
+					visit(k, rec.(*memRecord))
 				}
 			}
 		}
+		if done != nil {
+			done()
+		}
 		close(c)
 	}()
 
@@ -89,31 +337,36 @@ func (m *memTable) Scan(fn ScanFunc) <-chan interface{} {
 
 func (m *memTable) ScanP(fn ScanFunc) <-chan interface{} {
 	c := make(chan interface{})
+	ts := clock.acquire()
 
-	wg := new(sync.WaitGroup)
-	wg.Add(len(m.records))
-	m.lock.RLock()
-	for k, r := range m.records {
-		go func(k string, r interface{}, wg *sync.WaitGroup) {
-			defer wg.Done()
-			if ok, ret := fn(k, r); ok {
-				c <- ret
+	go func() {
+		wg := new(sync.WaitGroup)
+		m.records.Range(func(k, rec interface{}) bool {
+			v := rec.(*memRecord).at(ts)
+			if v == nil || v.deleted {
+				return true
 			}
-		}(k, r, wg)
-	}
-	m.lock.Unlock()
-	wg.Wait()
-	close(c)
+			wg.Add(1)
+			go func(k string, r interface{}) {
+				defer wg.Done()
+				if ok, ret := fn(k, r); ok {
+					c <- ret
+				}
+			}(k.(string), v.data)
+			return true
+		})
+		wg.Wait()
+		clock.release(ts)
+		close(c)
+	}()
 
 	return c
 }
 
 func (m *memTable) RecordsAsArray() []interface{} {
-	res := make([]interface{}, len(m.records))
-	i := 0
-	for _, rec := range m.records {
-		res[i] = rec
-		i++
+	res := []interface{}{}
+	for rec := range m.Scan(nil) {
+		res = append(res, rec)
 	}
 	return res
 }
@@ -0,0 +1,357 @@
+package flexmem
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// tableView is the set of table operations used by Query. It is implemented by
+// memTable for auto-commit access and by txTable for access inside a transaction
+type tableView interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, data interface{}, upsert bool) error
+	Delete(key string)
+	Scan(fn ScanFunc) <-chan interface{}
+	Find(where *memFilter) <-chan interface{}
+	FindSorted(where *memFilter, fields []sortField, limit int) ([]interface{}, bool)
+	Version(key string) (int64, bool)
+	SetVersion(key string, data interface{}, version int64) error
+	DeleteVersion(key string, version int64) error
+}
+
+// txWrite is the pending state of a record written in a transaction. base is the
+// version of the record in the snapshot of the transaction, and when check is
+// set the commit fails if the record has been changed since then
+type txWrite struct {
+	data    interface{}
+	deleted bool
+	insert  bool
+	base    int64
+	check   bool
+}
+
+// memTx holds the snapshot a transaction reads from and the writes it buffers
+type memTx struct {
+	ts     uint64
+	lock   *sync.RWMutex
+	tables map[string]*memTable
+	writes map[string]map[string]*txWrite
+}
+
+func newMemTx() *memTx {
+	tx := new(memTx)
+	tx.ts = clock.acquire()
+	tx.lock = new(sync.RWMutex)
+	tx.tables = map[string]*memTable{}
+	tx.writes = map[string]map[string]*txWrite{}
+	return tx
+}
+
+func (tx *memTx) table(mt *memTable) *txTable {
+	return &txTable{tx: tx, table: mt}
+}
+
+func (tx *memTx) get(tableName, key string) (*txWrite, bool) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	w, ok := tx.writes[tableName][key]
+	return w, ok
+}
+
+func (tx *memTx) put(mt *memTable, key string, w *txWrite) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	writes, ok := tx.writes[mt.name]
+	if !ok {
+		writes = map[string]*txWrite{}
+		tx.writes[mt.name] = writes
+		tx.tables[mt.name] = mt
+	}
+	writes[key] = w
+}
+
+func (tx *memTx) tableWrites(tableName string) map[string]*txWrite {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	res := make(map[string]*txWrite, len(tx.writes[tableName]))
+	for k, w := range tx.writes[tableName] {
+		res[k] = w
+	}
+	return res
+}
+
+// commit validates all buffered writes against the latest committed records
+// and then applies them with a single commit timestamp, so other connections
+// see either every write of the transaction or none of them
+func (tx *memTx) commit() error {
+	defer tx.release()
+
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return clock.commit(func(ts uint64) error {
+		//-- validation runs in a fixed order, so the error of a failed commit doesn't
+		//-- depend on map order: dropped tables, versions, inserted keys, unique indexes
+		tableNames := make([]string, 0, len(tx.writes))
+		for tableName := range tx.writes {
+			tableNames = append(tableNames, tableName)
+		}
+		sort.Strings(tableNames)
+
+		for _, tableName := range tableNames {
+			if tx.tables[tableName].dropped {
+				return fmt.Errorf("table %s has been dropped", tableName)
+			}
+		}
+		for _, tableName := range tableNames {
+			mt := tx.tables[tableName]
+			for key, w := range tx.writes[tableName] {
+				if !w.check {
+					continue
+				}
+				if e := mt.checkVersion(key, w.base); e != nil {
+					return e
+				}
+			}
+		}
+		for _, tableName := range tableNames {
+			mt := tx.tables[tableName]
+			for key, w := range tx.writes[tableName] {
+				if !w.insert {
+					continue
+				}
+				if _, exist := mt.latest(key); exist {
+					return &DuplicateKeyError{Table: tableName, Key: key}
+				}
+			}
+		}
+		for _, tableName := range tableNames {
+			mt := tx.tables[tableName]
+			writes := tx.writes[tableName]
+			for key, w := range writes {
+				if w.deleted {
+					continue
+				}
+				e := mt.checkUnique(latestTs, key, w.data, func(k string) bool {
+					_, ok := writes[k]
+					return ok
+				})
+				if e != nil {
+					return e
+				}
+			}
+		}
+
+		for tableName, writes := range tx.writes {
+			mt := tx.tables[tableName]
+			for key, w := range writes {
+				mt.write(key, w.data, w.deleted, ts)
+			}
+		}
+		return nil
+	})
+}
+
+// release frees the snapshot of the transaction
+func (tx *memTx) release() {
+	clock.release(tx.ts)
+}
+
+// txTable is a memTable seen through a transaction: reads merge the buffered
+// writes of the transaction over a snapshot of the committed records, and
+// writes are buffered until commit
+type txTable struct {
+	tx    *memTx
+	table *memTable
+}
+
+func (t *txTable) Get(key string) (interface{}, bool) {
+	if w, ok := t.tx.get(t.table.name, key); ok {
+		if w.deleted {
+			return nil, false
+		}
+		return w.data, true
+	}
+	return t.table.GetAt(key, t.tx.ts)
+}
+
+func (t *txTable) Set(key string, data interface{}, upsert bool) error {
+	w, inTx := t.tx.get(t.table.name, key)
+	_, inTable := t.table.GetAt(key, t.tx.ts)
+
+	exist := inTable
+	if inTx {
+		exist = !w.deleted
+	}
+	if exist && !upsert {
+		return &DuplicateKeyError{Table: t.table.name, Key: key}
+	}
+	if e := t.checkUnique(key, data); e != nil {
+		return e
+	}
+
+	//-- a record of the snapshot is checked on commit, so a concurrent update
+	//-- of the record is not overwritten
+	t.put(key, &txWrite{data: data, insert: !inTable, check: inTable})
+	return nil
+}
+
+func (t *txTable) Delete(key string) {
+	_, inTable := t.table.GetAt(key, t.tx.ts)
+	t.put(key, &txWrite{deleted: true, check: inTable})
+}
+
+// Version returns the version of a record as seen by the transaction. A record
+// written in the transaction is one version above its snapshot
+func (t *txTable) Version(key string) (int64, bool) {
+	if w, ok := t.tx.get(t.table.name, key); ok {
+		if w.deleted {
+			return 0, false
+		}
+		return w.base + 1, true
+	}
+	return t.table.VersionAt(key, t.tx.ts)
+}
+
+func (t *txTable) SetVersion(key string, data interface{}, version int64) error {
+	if e := t.checkVersion(key, version); e != nil {
+		return e
+	}
+	if e := t.checkUnique(key, data); e != nil {
+		return e
+	}
+	_, inTable := t.table.GetAt(key, t.tx.ts)
+	t.put(key, &txWrite{data: data, insert: !inTable, check: true})
+	return nil
+}
+
+func (t *txTable) DeleteVersion(key string, version int64) error {
+	if e := t.checkVersion(key, version); e != nil {
+		return e
+	}
+	t.put(key, &txWrite{deleted: true, check: true})
+	return nil
+}
+
+func (t *txTable) checkVersion(key string, version int64) error {
+	if rev, _ := t.Version(key); rev != version {
+		return &VersionConflictError{Table: t.table.name, Key: key, Expected: version, Actual: rev}
+	}
+	return nil
+}
+
+// checkUnique validates unique indexes against the snapshot of the transaction
+// and the other records written in it. Commit validates them again against the
+// latest committed records
+func (t *txTable) checkUnique(key string, data interface{}) error {
+	writes := t.tx.tableWrites(t.table.name)
+	e := t.table.checkUnique(t.tx.ts, key, data, func(k string) bool {
+		_, ok := writes[k]
+		return ok
+	})
+	if e != nil {
+		return e
+	}
+
+	t.table.indexLock.RLock()
+	defer t.table.indexLock.RUnlock()
+	for _, ix := range t.table.indexes {
+		if !ix.declaration().Unique {
+			continue
+		}
+		for _, value := range uniqueValues(ix, data) {
+			for k, w := range writes {
+				if k != key && !w.deleted && hasIndexValue(ix, w.data, value) {
+					return &DuplicateKeyError{Table: t.table.name, Index: ix.declaration().name(), Key: key, Existing: k, Value: value}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// put buffers a write, keeping the snapshot version of the first write of the
+// record in the transaction
+func (t *txTable) put(key string, w *txWrite) {
+	if prev, ok := t.tx.get(t.table.name, key); ok {
+		w.base = prev.base
+		w.check = w.check || prev.check
+	} else {
+		w.base, _ = t.table.VersionAt(key, t.tx.ts)
+	}
+	t.tx.put(t.table, key, w)
+}
+
+func (t *txTable) Scan(fn ScanFunc) <-chan interface{} {
+	c := make(chan interface{})
+	writes := t.tx.tableWrites(t.table.name)
+
+	go func() {
+		cBase := t.table.ScanAt(t.tx.ts, func(k string, r interface{}) (bool, interface{}) {
+			if _, ok := writes[k]; ok {
+				return false, nil
+			}
+			if fn == nil {
+				return true, r
+			}
+			return fn(k, r)
+		})
+		for r := range cBase {
+			c <- r
+		}
+
+		for k, w := range writes {
+			if w.deleted {
+				continue
+			}
+			if fn == nil {
+				c <- w.data
+			} else if ok, ret := fn(k, w.data); ok {
+				c <- ret
+			}
+		}
+		close(c)
+	}()
+
+	return c
+}
+
+func (t *txTable) Find(where *memFilter) <-chan interface{} {
+	c := make(chan interface{})
+	writes := t.tx.tableWrites(t.table.name)
+
+	go func() {
+		cBase := t.table.FindAt(t.tx.ts, where, func(k string) bool {
+			_, ok := writes[k]
+			return ok
+		}, nil)
+		for r := range cBase {
+			c <- r
+		}
+
+		for _, w := range writes {
+			if w.deleted {
+				continue
+			}
+			if where == nil || where.Match(w.data) {
+				c <- w.data
+			}
+		}
+		close(c)
+	}()
+
+	return c
+}
+
+// FindSorted uses the ordered indexes of the table only when the transaction
+// has no pending writes on it
+func (t *txTable) FindSorted(where *memFilter, fields []sortField, limit int) ([]interface{}, bool) {
+	if len(t.tx.tableWrites(t.table.name)) > 0 {
+		return nil, false
+	}
+	return t.table.findSortedAt(t.tx.ts, where, fields, limit)
+}
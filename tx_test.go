@@ -0,0 +1,110 @@
+package flexmem_test
+
+import (
+	"fmt"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestTx(t *testing.T) {
+	t.Parallel()
+	convey.Convey("transaction", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		tableName := new(Obj).TableName()
+
+		convey.So(conn.SupportTx(), convey.ShouldBeTrue)
+		convey.So(conn.BeginTx(), convey.ShouldBeNil)
+		convey.So(conn.IsTx(), convey.ShouldBeTrue)
+		for i := 1; i <= 10; i++ {
+			obj := newObj(fmt.Sprintf("tx-%d", i), randSeed)
+			obj.Index = i
+			_, e := conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+			convey.So(e, convey.ShouldBeNil)
+		}
+		_, e := conn.Execute(dbflex.From(tableName).Where(dbflex.Lte("Index", 3)).Delete(), nil)
+		convey.So(e, convey.ShouldBeNil)
+
+		convey.Convey("isolation", func() {
+			other := flexmemtest.Connect(t, conn)
+
+			convey.So(conn.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 7)
+			convey.So(other.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 0)
+
+			_, e := other.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", newObj("other-1", randSeed)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(conn.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 7)
+			convey.So(other.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 1)
+
+			convey.So(conn.Commit(), convey.ShouldBeNil)
+			convey.So(other.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 8)
+		})
+
+		convey.Convey("rollback", func() {
+			convey.So(conn.RollBack(), convey.ShouldBeNil)
+			convey.So(conn.IsTx(), convey.ShouldBeFalse)
+			convey.So(conn.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("commit", func() {
+			convey.So(conn.Commit(), convey.ShouldBeNil)
+			convey.So(conn.IsTx(), convey.ShouldBeFalse)
+			convey.So(conn.Cursor(dbflex.From(tableName).Select(), nil).Count(), convey.ShouldEqual, 7)
+		})
+	})
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+	convey.Convey("record version", t, func() {
+		conn := flexmemtest.New(t, new(Obj))
+		tableName := new(Obj).TableName()
+
+		obj := newObj("version-1", randSeed)
+		conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", obj))
+		version, e := conn.RecordVersion(tableName, obj.ID)
+		convey.So(e, convey.ShouldBeNil)
+		convey.So(version, convey.ShouldEqual, 1)
+
+		cmd := dbflex.From(tableName).Where(dbflex.Eq("ID", obj.ID)).Update("Seed")
+		_, e = conn.Execute(cmd, toolkit.M{}.Set("data", obj).Set(flexmem.ParmVersion, 1))
+		convey.So(e, convey.ShouldBeNil)
+		version, _ = conn.RecordVersion(tableName, obj.ID)
+		convey.So(version, convey.ShouldEqual, 2)
+
+		_, e = conn.Execute(cmd, toolkit.M{}.Set("data", obj).Set(flexmem.ParmVersion, 1))
+		convey.So(flexmem.IsVersionConflict(e), convey.ShouldBeTrue)
+
+		convey.Convey("conflict on commit", func() {
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			_, e = conn.Execute(cmd, toolkit.M{}.Set("data", obj).Set(flexmem.ParmVersion, 2))
+			convey.So(e, convey.ShouldBeNil)
+
+			other := flexmemtest.Connect(t, conn)
+			_, e = other.Execute(cmd, toolkit.M{}.Set("data", obj).Set(flexmem.ParmVersion, 2))
+			convey.So(e, convey.ShouldBeNil)
+
+			// the version conflict is reported before the duplicate key
+			_, e = conn.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", newObj("version-2", randSeed)))
+			convey.So(e, convey.ShouldBeNil)
+			_, e = other.Execute(dbflex.From(tableName).Insert(), toolkit.M{}.Set("data", newObj("version-2", randSeed)))
+			convey.So(e, convey.ShouldBeNil)
+
+			e = conn.Commit()
+			convey.So(flexmem.IsVersionConflict(e), convey.ShouldBeTrue)
+			version, _ = conn.RecordVersion(tableName, obj.ID)
+			convey.So(version, convey.ShouldEqual, 3)
+		})
+
+		convey.Convey("delete", func() {
+			_, e = conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", obj.ID)).Delete(), toolkit.M{}.Set(flexmem.ParmVersion, 1))
+			convey.So(flexmem.IsVersionConflict(e), convey.ShouldBeTrue)
+			_, e = conn.Execute(dbflex.From(tableName).Where(dbflex.Eq("ID", obj.ID)).Delete(), toolkit.M{}.Set(flexmem.ParmVersion, 2))
+			convey.So(e, convey.ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,322 @@
+package flexmem
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+)
+
+// UpdateOperator is the operation of an UpdateOp
+type UpdateOperator string
+
+const (
+	UpdateSet         UpdateOperator = "$set"
+	UpdateUnset       UpdateOperator = "$unset"
+	UpdateInc         UpdateOperator = "$inc"
+	UpdatePush        UpdateOperator = "$push"
+	UpdatePull        UpdateOperator = "$pull"
+	UpdateSetOnInsert UpdateOperator = "$setOnInsert"
+)
+
+// UpdateOp is an operation applied to a field of every record matched by an
+// update or written by a save. Operations are passed to Execute in the ParmOps
+// parameter, either as a single UpdateOp or as []UpdateOp
+type UpdateOp struct {
+	Op    UpdateOperator
+	Field string
+	Value interface{}
+}
+
+// Set sets the field, a dotted path into a map sets the key of the map
+func Set(field string, value interface{}) UpdateOp {
+	return UpdateOp{Op: UpdateSet, Field: field, Value: value}
+}
+
+// Unset removes the key from a map or resets a struct field to its zero value
+func Unset(field string) UpdateOp {
+	return UpdateOp{Op: UpdateUnset, Field: field}
+}
+
+// Inc increments a numeric field, a missing or nil field counts as 0
+func Inc(field string, by interface{}) UpdateOp {
+	return UpdateOp{Op: UpdateInc, Field: field, Value: by}
+}
+
+// Dec decrements a numeric field, a missing or nil field counts as 0
+func Dec(field string, by interface{}) UpdateOp {
+	rv := reflect.ValueOf(by)
+	switch {
+	case isInt(rv):
+		by = -rv.Int()
+	case isUint(rv):
+		by = -int64(rv.Uint())
+	case valueKind(rv) == kindNumber:
+		by = -rv.Float()
+	}
+	return UpdateOp{Op: UpdateInc, Field: field, Value: by}
+}
+
+// Push appends values to an array field
+func Push(field string, values ...interface{}) UpdateOp {
+	return UpdateOp{Op: UpdatePush, Field: field, Value: values}
+}
+
+// Pull removes the elements of an array field that are equal to any of the
+// values, or that match the filter when a single *dbflex.Filter is given
+func Pull(field string, values ...interface{}) UpdateOp {
+	return UpdateOp{Op: UpdatePull, Field: field, Value: values}
+}
+
+// SetOnInsert sets the field only when the record is inserted by an upsert or a save
+func SetOnInsert(field string, value interface{}) UpdateOp {
+	return UpdateOp{Op: UpdateSetOnInsert, Field: field, Value: value}
+}
+
+// UpdateResult is returned by Execute of an update. Matched is the number of
+// records matching the filter and Modified the number of records changed by the
+// update. UpsertedKey is the key of the record inserted by an upsert, and Records
+// holds the updated or inserted records when ParmReturnRecords is set
+type UpdateResult struct {
+	Matched     int
+	Modified    int
+	UpsertedKey string
+	Records     []interface{}
+}
+
+// toM returns data when it is a map of field to value, like the patch of an
+// update or a document of a schemaless table
+func toM(data interface{}) (toolkit.M, bool) {
+	switch patch := data.(type) {
+	case toolkit.M:
+		return patch, true
+	case map[string]interface{}:
+		return toolkit.M(patch), true
+	}
+	return nil, false
+}
+
+// patchUpdateOps returns the operations of a map of changed fields. Every key, or
+// only those in fields when given, sets the field of that name or dotted path.
+// Keys named after an UpdateOperator, like "$inc", hold a map of field to value
+// of that operation
+func patchUpdateOps(patch toolkit.M, fields []string) ([]UpdateOp, error) {
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	selected := map[string]bool{}
+	for _, field := range fields {
+		selected[field] = true
+	}
+
+	ops := []UpdateOp{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "$") {
+			if len(fields) == 0 || selected[key] {
+				ops = append(ops, Set(key, patch[key]))
+			}
+			continue
+		}
+
+		op := UpdateOperator(key)
+		switch op {
+		case UpdateSet, UpdateUnset, UpdateInc, UpdatePush, UpdatePull, UpdateSetOnInsert:
+		default:
+			return nil, fmt.Errorf("update operator %s is not supported", op)
+		}
+		values, ok := toM(patch[key])
+		if !ok {
+			return nil, fmt.Errorf("value of %s should be a map of field to value", op)
+		}
+		opFields := make([]string, 0, len(values))
+		for field := range values {
+			opFields = append(opFields, field)
+		}
+		sort.Strings(opFields)
+		for _, field := range opFields {
+			ops = append(ops, UpdateOp{Op: op, Field: field, Value: values[field]})
+		}
+	}
+	return ops, nil
+}
+
+// updateOps reads the update operations of the ParmOps parameter
+func updateOps(v interface{}) ([]UpdateOp, error) {
+	switch ops := v.(type) {
+	case nil:
+		return nil, nil
+	case UpdateOp:
+		return []UpdateOp{ops}, nil
+	case []UpdateOp:
+		return ops, nil
+	}
+	return nil, fmt.Errorf("invalid %s parameter: %v", ParmOps, v)
+}
+
+// applyUpdateOps applies the operations to a record, SetOnInsert operations are
+// only applied when the record is being inserted
+func (qr *Query) applyUpdateOps(rec interface{}, ops []UpdateOp, inserting bool) error {
+	for _, op := range ops {
+		var e error
+		switch op.Op {
+		case UpdateSet:
+			e = setFieldValue(rec, op.Field, op.Value)
+
+		case UpdateSetOnInsert:
+			if inserting {
+				e = setFieldValue(rec, op.Field, op.Value)
+			}
+
+		case UpdateUnset:
+			e = unsetFieldValue(rec, op.Field)
+
+		case UpdateInc:
+			e = incField(rec, op.Field, op.Value)
+
+		case UpdatePush:
+			e = pushField(rec, op.Field, filterValues(op.Value))
+
+		case UpdatePull:
+			e = qr.pullField(rec, op.Field, filterValues(op.Value))
+
+		default:
+			e = fmt.Errorf("update operator %s is not supported", op.Op)
+		}
+		if e != nil {
+			return fmt.Errorf("%s on %s failed. %s", op.Op, op.Field, e.Error())
+		}
+	}
+	return nil
+}
+
+func incField(rec interface{}, field string, by interface{}) error {
+	rby := reflect.ValueOf(by)
+	if valueKind(rby) != kindNumber {
+		return fmt.Errorf("increment %v is not a number", by)
+	}
+
+	current, _ := getFieldValue(rec, field)
+	rcur := reflect.ValueOf(current)
+	if isNilValue(current) {
+		return setFieldValue(rec, field, by)
+	}
+	if valueKind(rcur) != kindNumber {
+		return fmt.Errorf("value %v is not a number", current)
+	}
+
+	integer := func(rv reflect.Value) (int64, bool) {
+		switch {
+		case isInt(rv):
+			return rv.Int(), true
+		case isUint(rv):
+			return int64(rv.Uint()), true
+		}
+		return 0, false
+	}
+
+	var res interface{}
+	icur, curIsInt := integer(rcur)
+	iby, byIsInt := integer(rby)
+	switch {
+	case curIsInt && byIsInt:
+		res = icur + iby
+	case curIsInt:
+		res = int64(toFloat(rcur) + toFloat(rby))
+	default:
+		res = toFloat(rcur) + toFloat(rby)
+	}
+	return setFieldValue(rec, field, reflect.ValueOf(res).Convert(rcur.Type()).Interface())
+}
+
+// pushField appends values to the array of a field keeping its type, a missing
+// field becomes a []interface{}
+func pushField(rec interface{}, field string, values []interface{}) error {
+	current, _ := getFieldValue(rec, field)
+	rcur := reflect.ValueOf(current)
+	if isNilValue(current) && rcur.Kind() != reflect.Slice {
+		return setFieldValue(rec, field, append([]interface{}{}, values...))
+	}
+	if rcur.Kind() != reflect.Slice {
+		return fmt.Errorf("value %v is not an array", current)
+	}
+
+	res := reflect.MakeSlice(rcur.Type(), 0, rcur.Len()+len(values))
+	res = reflect.AppendSlice(res, rcur)
+	for _, v := range values {
+		elem := reflect.New(rcur.Type().Elem()).Elem()
+		if e := assignValue(elem, v); e != nil {
+			return e
+		}
+		res = reflect.Append(res, elem)
+	}
+	return setFieldValue(rec, field, res.Interface())
+}
+
+// pullField removes elements of the array of a field that are equal to any of
+// values or match the filter
+func (qr *Query) pullField(rec interface{}, field string, values []interface{}) error {
+	current, _ := getFieldValue(rec, field)
+	rcur := reflect.ValueOf(current)
+	if isNilValue(current) {
+		return nil
+	}
+	if rcur.Kind() != reflect.Slice {
+		return fmt.Errorf("value %v is not an array", current)
+	}
+
+	match := func(elem interface{}) bool {
+		return inValues(elem, values)
+	}
+	if len(values) == 1 {
+		if f, ok := values[0].(*dbflex.Filter); ok {
+			mf, e := qr.compileFilter(f)
+			if e != nil {
+				return e
+			}
+			match = mf.Match
+		}
+	}
+
+	res := reflect.MakeSlice(rcur.Type(), 0, rcur.Len())
+	for i := 0; i < rcur.Len(); i++ {
+		if !match(rcur.Index(i).Interface()) {
+			res = reflect.Append(res, rcur.Index(i))
+		}
+	}
+	return setFieldValue(rec, field, res.Interface())
+}
+
+// upsertRecord returns the record inserted by an update that matches nothing,
+// which is a copy of data or a new record of the model of the table having the
+// values of the Eq filters of the update
+func (qr *Query) upsertRecord(table *memTable, where *memFilter, data interface{}) (interface{}, error) {
+	if data != nil {
+		return cloneRecord(data), nil
+	}
+
+	rec, e := table.newRecord()
+	if e != nil {
+		return nil, e
+	}
+	var assign func(f *dbflex.Filter)
+	assign = func(f *dbflex.Filter) {
+		switch f.Op {
+		case dbflex.OpEq:
+			setFieldValue(rec, f.Field, f.Value)
+		case dbflex.OpAnd:
+			for _, item := range f.Items {
+				assign(item)
+			}
+		}
+	}
+	if where != nil {
+		assign(where.filter)
+	}
+	return rec, nil
+}
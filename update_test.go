@@ -0,0 +1,314 @@
+package flexmem_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"git.kanosolution.net/kano/dbflex"
+	"github.com/eaciit/toolkit"
+	"github.com/kanoteknologi/flexmem"
+	"github.com/kanoteknologi/flexmem/flexmemtest"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestUpdateOperators(t *testing.T) {
+	t.Parallel()
+	convey.Convey("update operators", t, func() {
+		conn := flexmemtest.New(t, new(Order), new(Counter))
+
+		order := &Order{
+			ID:    "order-1",
+			Items: []OrderItem{{Qty: 1}, {Qty: 2}, {Qty: 3}},
+			Tags:  []string{"new", "promo"},
+			Extra: toolkit.M{"Channel": "web", "Note": "fragile"},
+		}
+		_, e := conn.Execute(dbflex.From("orders").Insert(), toolkit.M{}.Set("data", order))
+		convey.So(e, convey.ShouldBeNil)
+		for i := 1; i <= 3; i++ {
+			_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: i, Count: 10}))
+			convey.So(e, convey.ShouldBeNil)
+		}
+
+		update := func(table string, where *dbflex.Filter, parm toolkit.M) error {
+			_, e := conn.Execute(dbflex.From(table).Where(where).Update(), parm)
+			return e
+		}
+		getOrder := func() *Order {
+			res := new(Order)
+			conn.Cursor(dbflex.From("orders").Where(dbflex.Eq("ID", "order-1")).Select(), nil).Fetch(res).Close()
+			return res
+		}
+		counts := func() []int {
+			counters := []Counter{}
+			conn.Cursor(dbflex.From("counters").OrderBy("ID").Select(), nil).Fetchs(&counters, 0).Close()
+			res := []int{}
+			for _, c := range counters {
+				res = append(res, c.Count)
+			}
+			return res
+		}
+
+		convey.Convey("increment", func() {
+			e := update("counters", dbflex.Lte("ID", 2), toolkit.M{}.Set(flexmem.ParmOps, flexmem.Inc("Count", 5)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(counts(), convey.ShouldResemble, []int{15, 15, 10})
+
+			e = update("counters", dbflex.Eq("ID", 3), toolkit.M{}.Set(flexmem.ParmOps, flexmem.Dec("Count", 1.5)))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(counts(), convey.ShouldResemble, []int{15, 15, 8})
+
+			e = update("counters", dbflex.Eq("ID", 3), toolkit.M{}.Set(flexmem.ParmOps, flexmem.Inc("Count", "a")))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("arrays and maps", func() {
+			e := update("orders", dbflex.Eq("ID", "order-1"), toolkit.M{}.Set(flexmem.ParmOps, []flexmem.UpdateOp{
+				flexmem.Push("Tags", "vip", "gift"),
+				flexmem.Pull("Tags", "promo"),
+				flexmem.Pull("Items", dbflex.Lt("Qty", 3)),
+				flexmem.Push("Items", OrderItem{Qty: 9}),
+				flexmem.Set("Extra.Channel", "mobile"),
+				flexmem.Unset("Extra.Note"),
+				flexmem.Inc("Extra.Visits", 1),
+				flexmem.Set("Address.City", "Jakarta"),
+			}))
+			convey.So(e, convey.ShouldBeNil)
+
+			res := getOrder()
+			convey.So(res.Tags, convey.ShouldResemble, []string{"new", "vip", "gift"})
+			convey.So(len(res.Items), convey.ShouldEqual, 2)
+			convey.So(res.Items[0].Qty, convey.ShouldEqual, 3)
+			convey.So(res.Items[1].Qty, convey.ShouldEqual, 9)
+			convey.So(res.Extra.GetString("Channel"), convey.ShouldEqual, "mobile")
+			convey.So(res.Extra.Has("Note"), convey.ShouldBeFalse)
+			convey.So(res.Extra.GetInt("Visits"), convey.ShouldEqual, 1)
+			convey.So(res.Address.City, convey.ShouldEqual, "Jakarta")
+			convey.So(order.Tags, convey.ShouldResemble, []string{"new", "promo"})
+
+			e = update("orders", dbflex.Eq("ID", "order-1"), toolkit.M{}.Set(flexmem.ParmOps, flexmem.Unset("Tags")))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(len(getOrder().Tags), convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("upsert", func() {
+			parm := toolkit.M{}.Set(flexmem.ParmUpsert, true).Set(flexmem.ParmOps, []flexmem.UpdateOp{
+				flexmem.Inc("Count", 1),
+				flexmem.SetOnInsert("Count", 50),
+			})
+			convey.So(update("counters", dbflex.Eq("ID", 3), parm), convey.ShouldBeNil)
+			convey.So(counts(), convey.ShouldResemble, []int{10, 10, 11})
+
+			convey.So(update("counters", dbflex.Eq("ID", 4), parm), convey.ShouldBeNil)
+			convey.So(counts(), convey.ShouldResemble, []int{10, 10, 11, 50})
+			convey.So(update("counters", dbflex.Eq("ID", 4), parm), convey.ShouldBeNil)
+			convey.So(counts(), convey.ShouldResemble, []int{10, 10, 11, 51})
+		})
+	})
+}
+
+func TestUpdatePatch(t *testing.T) {
+	t.Parallel()
+	convey.Convey("update with map", t, func() {
+		conn := flexmemtest.New(t, new(Order))
+
+		for _, id := range []string{"order-1", "order-2", "order-3"} {
+			order := &Order{ID: id, Tags: []string{"new"}, Extra: toolkit.M{"Channel": "web"}}
+			_, e := conn.Execute(dbflex.From("orders").Insert(), toolkit.M{}.Set("data", order))
+			convey.So(e, convey.ShouldBeNil)
+		}
+		getOrder := func(id string) *Order {
+			res := new(Order)
+			conn.Cursor(dbflex.From("orders").Where(dbflex.Eq("ID", id)).Select(), nil).Fetch(res).Close()
+			return res
+		}
+
+		convey.Convey("changed fields", func() {
+			patch := toolkit.M{"Address.City": "Bandung", "Extra.Channel": "mobile", "Tags": []string{"vip"}}
+			_, e := conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-1")).Update(), toolkit.M{}.Set("data", patch))
+			convey.So(e, convey.ShouldBeNil)
+			res := getOrder("order-1")
+			convey.So(res.Address.City, convey.ShouldEqual, "Bandung")
+			convey.So(res.Extra.GetString("Channel"), convey.ShouldEqual, "mobile")
+			convey.So(res.Tags, convey.ShouldResemble, []string{"vip"})
+
+			_, e = conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-2")).Update("Tags"), toolkit.M{}.Set("data", patch))
+			convey.So(e, convey.ShouldBeNil)
+			res = getOrder("order-2")
+			convey.So(res.Tags, convey.ShouldResemble, []string{"vip"})
+			convey.So(res.Address.City, convey.ShouldEqual, "")
+
+			_, e = conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-2")).Update(), toolkit.M{}.Set("data", toolkit.M{"Total": 1}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("operators", func() {
+			patch := toolkit.M{
+				"$push":  toolkit.M{"Tags": "promo"},
+				"$inc":   toolkit.M{"Extra.Visits": 2},
+				"$unset": toolkit.M{"Extra.Channel": ""},
+			}
+			_, e := conn.Execute(dbflex.From("orders").Where(dbflex.Ne("ID", "order-3")).Update(), toolkit.M{}.Set("data", patch))
+			convey.So(e, convey.ShouldBeNil)
+			for _, id := range []string{"order-1", "order-2"} {
+				res := getOrder(id)
+				convey.So(res.Tags, convey.ShouldResemble, []string{"new", "promo"})
+				convey.So(res.Extra.GetInt("Visits"), convey.ShouldEqual, 2)
+				convey.So(res.Extra.Has("Channel"), convey.ShouldBeFalse)
+			}
+			convey.So(getOrder("order-3").Tags, convey.ShouldResemble, []string{"new"})
+
+			_, e = conn.Execute(dbflex.From("orders").Update(), toolkit.M{}.Set("data", toolkit.M{"$rename": toolkit.M{"Tags": "Labels"}}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+
+		convey.Convey("delete", func() {
+			n, e := conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-1")).Delete(), toolkit.M{}.Set("data", toolkit.M{}))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(n, convey.ShouldEqual, 1)
+			n, e = conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-2")).Delete(), toolkit.M{}.Set("data", "order-2"))
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(n, convey.ShouldEqual, 1)
+			n, e = conn.Execute(dbflex.From("orders").Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(n, convey.ShouldEqual, 1)
+		})
+
+		convey.Convey("insert needs a model", func() {
+			_, e := conn.Execute(dbflex.From("orders").Insert(), toolkit.M{}.Set("data", toolkit.M{"ID": "order-4"}))
+			convey.So(e, convey.ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUpdateResult(t *testing.T) {
+	t.Parallel()
+	convey.Convey("update result", t, func() {
+		conn := flexmemtest.New(t, new(Counter))
+
+		for i := 1; i <= 4; i++ {
+			_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: i, Count: i % 2}))
+			convey.So(e, convey.ShouldBeNil)
+		}
+
+		update := func(where *dbflex.Filter, parm toolkit.M) *flexmem.UpdateResult {
+			res, e := conn.Execute(dbflex.From("counters").Where(where).Update(), parm)
+			convey.So(e, convey.ShouldBeNil)
+			return res.(*flexmem.UpdateResult)
+		}
+
+		res := update(dbflex.Lte("ID", 3), toolkit.M{}.Set("data", toolkit.M{"Count": 1}))
+		convey.So(res.Matched, convey.ShouldEqual, 3)
+		convey.So(res.Modified, convey.ShouldEqual, 1)
+		convey.So(len(res.Records), convey.ShouldEqual, 0)
+
+		res = update(dbflex.Gt("ID", 10), toolkit.M{}.Set("data", toolkit.M{"Count": 1}))
+		convey.So(res.Matched, convey.ShouldEqual, 0)
+		convey.So(res.Modified, convey.ShouldEqual, 0)
+
+		res = update(dbflex.Gte("ID", 3), toolkit.M{}.
+			Set(flexmem.ParmOps, flexmem.Inc("Count", 10)).
+			Set(flexmem.ParmReturnRecords, true))
+		convey.So(res.Matched, convey.ShouldEqual, 2)
+		convey.So(res.Modified, convey.ShouldEqual, 2)
+		convey.So(len(res.Records), convey.ShouldEqual, 2)
+		for _, rec := range res.Records {
+			convey.So(rec.(*Counter).Count, convey.ShouldBeGreaterThanOrEqualTo, 10)
+		}
+
+		res = update(dbflex.Eq("ID", 9), toolkit.M{}.
+			Set(flexmem.ParmOps, flexmem.Inc("Count", 1)).
+			Set(flexmem.ParmUpsert, true).
+			Set(flexmem.ParmReturnRecords, true))
+		convey.So(res.Matched, convey.ShouldEqual, 0)
+		convey.So(res.UpsertedKey, convey.ShouldEqual, "9")
+		convey.So(res.Records[0].(*Counter).ID, convey.ShouldEqual, 9)
+	})
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	t.Parallel()
+	convey.Convey("concurrent update", t, func() {
+		conn := flexmemtest.New(t, new(Counter), new(Order))
+		_, e := conn.Execute(dbflex.From("counters").Insert(), toolkit.M{}.Set("data", &Counter{ID: 1, Count: 10}))
+		convey.So(e, convey.ShouldBeNil)
+		_, e = conn.Execute(dbflex.From("orders").Insert(), toolkit.M{}.Set("data", &Order{ID: "order-1"}))
+		convey.So(e, convey.ShouldBeNil)
+
+		workers, count := 8, 50
+		wg := new(sync.WaitGroup)
+		errs := make(chan error, workers*count*2)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < count; i++ {
+					_, e := conn.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Update(),
+						toolkit.M{}.Set(flexmem.ParmOps, flexmem.Inc("Count", 1)))
+					errs <- e
+					_, e = conn.Execute(dbflex.From("orders").Where(dbflex.Eq("ID", "order-1")).Update(),
+						toolkit.M{}.Set(flexmem.ParmOps, flexmem.Push("Tags", fmt.Sprintf("%d-%d", w, i))))
+					errs <- e
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for e := range errs {
+			convey.So(e, convey.ShouldBeNil)
+		}
+
+		counter := new(Counter)
+		conn.Cursor(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Select(), nil).Fetch(counter).Close()
+		convey.So(counter.Count, convey.ShouldEqual, 10+workers*count)
+		order := new(Order)
+		conn.Cursor(dbflex.From("orders").Where(dbflex.Eq("ID", "order-1")).Select(), nil).Fetch(order).Close()
+		convey.So(len(order.Tags), convey.ShouldEqual, workers*count)
+
+		convey.Convey("deleted records are not updated", func() {
+			wg := new(sync.WaitGroup)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < count; i++ {
+						conn.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Update(),
+							toolkit.M{}.Set(flexmem.ParmOps, flexmem.Inc("Count", 1)))
+					}
+				}()
+			}
+			_, e := conn.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			wg.Wait()
+			convey.So(conn.Cursor(dbflex.From("counters").Select(), nil).Count(), convey.ShouldEqual, 0)
+		})
+
+		convey.Convey("overlapping transactions", func() {
+			other := flexmemtest.Connect(t, conn)
+			inc := func(conn *flexmem.Connection) error {
+				_, e := conn.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Update(),
+					toolkit.M{}.Set(flexmem.ParmOps, flexmem.Inc("Count", 1)))
+				return e
+			}
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			convey.So(other.BeginTx(), convey.ShouldBeNil)
+			convey.So(inc(conn), convey.ShouldBeNil)
+			convey.So(inc(other), convey.ShouldBeNil)
+			convey.So(other.Commit(), convey.ShouldBeNil)
+			convey.So(flexmem.IsVersionConflict(conn.Commit()), convey.ShouldBeTrue)
+
+			counter := new(Counter)
+			conn.Cursor(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Select(), nil).Fetch(counter).Close()
+			convey.So(counter.Count, convey.ShouldEqual, 11+workers*count)
+
+			convey.So(conn.BeginTx(), convey.ShouldBeNil)
+			convey.So(other.BeginTx(), convey.ShouldBeNil)
+			convey.So(inc(conn), convey.ShouldBeNil)
+			_, e := other.Execute(dbflex.From("counters").Where(dbflex.Eq("ID", 1)).Delete(), nil)
+			convey.So(e, convey.ShouldBeNil)
+			convey.So(conn.Commit(), convey.ShouldBeNil)
+			convey.So(flexmem.IsVersionConflict(other.Commit()), convey.ShouldBeTrue)
+			convey.So(conn.Cursor(dbflex.From("counters").Select(), nil).Count(), convey.ShouldEqual, 1)
+		})
+	})
+}